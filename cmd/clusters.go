@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/bpineau/katafygio/pkg/client"
+	"github.com/bpineau/katafygio/pkg/event"
+	"github.com/bpineau/katafygio/pkg/health"
+	"github.com/bpineau/katafygio/pkg/observer"
+	"github.com/bpineau/katafygio/pkg/recorder"
+	"github.com/bpineau/katafygio/pkg/store"
+)
+
+// clusterConfig describes a cluster to backup, in multi-cluster mode. Empty
+// fields default to the global api-server, context and kube-config settings.
+type clusterConfig struct {
+	Name       string `mapstructure:"name"`
+	APIServer  string `mapstructure:"api-server"`
+	Context    string `mapstructure:"context"`
+	KubeConfig string `mapstructure:"kube-config"`
+}
+
+// backup dumps a cluster's objects to the local directory (or to a
+// subdirectory named after the cluster, in multi-cluster mode)
+type backup struct {
+	name     string
+	recorder *recorder.Listener
+	observer *observer.Observer
+}
+
+// clusterChanges tags the changes notifications with the cluster name, so
+// commit messages tell which cluster they come from
+type clusterChanges struct {
+	cluster string
+	changes store.Changelog
+}
+
+func (c *clusterChanges) Send(notif *event.Notification) {
+	notif.Cluster = c.cluster
+	c.changes.Send(notif)
+}
+
+// client returns a client for the cluster, unset settings defaulting to the
+// global ones
+func (cl clusterConfig) client() (client.Interface, error) {
+	cfg := clusterConfig{APIServer: apiServer, Context: context, KubeConfig: kubeConf}
+	if cl.APIServer != "" {
+		cfg.APIServer = cl.APIServer
+	}
+	if cl.Context != "" {
+		cfg.Context = cl.Context
+	}
+	if cl.KubeConfig != "" {
+		cfg.KubeConfig = cl.KubeConfig
+	}
+
+	return client.New(cfg.APIServer, cfg.Context, cfg.KubeConfig)
+}
+
+// restoredCluster returns the cluster to restore, in multi-cluster mode. As
+// each cluster is dumped to its own subdirectory, one must be selected
+// (unless a single one is configured).
+func restoredCluster() (*clusterConfig, error) {
+	if restoreCluster == "" && len(clusters) > 1 {
+		return nil, fmt.Errorf("several clusters are configured: select the one to restore with --cluster")
+	}
+
+	for _, cl := range clusters {
+		if restoreCluster == "" || cl.Name == restoreCluster {
+			return &cl, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown cluster %q", restoreCluster)
+}
+
+// checkClusters validates the clusters names, as they are used as directories names
+func checkClusters(clusters []clusterConfig) error {
+	seen := make(map[string]bool)
+	for _, cl := range clusters {
+		if cl.Name == "" || cl.Name == "." || cl.Name == ".." || cl.Name == ".git" ||
+			strings.ContainsAny(cl.Name, `/\:`) {
+			return fmt.Errorf("invalid cluster name %q", cl.Name)
+		}
+		if seen[cl.Name] {
+			return fmt.Errorf("duplicate cluster name %q", cl.Name)
+		}
+		seen[cl.Name] = true
+	}
+	return nil
+}
+
+// startBackups starts a recorder and an observer for each configured cluster.
+// A cluster failing to start (ie. because of an invalid kubeconfig context) is
+// reported by the health endpoint and doesn't prevent the others to start.
+// Held recorders don't write until released (see recorder.Hold).
+func startBackups(logger *logrus.Logger, http *health.Listener, repo store.Backend,
+	fact observer.ControllerFactory, paths *recorder.Layout, hold bool) ([]*backup, error) {
+
+	if len(clusters) == 0 {
+		bk, err := startBackup(logger, repo, fact, paths, "", localDir, restcfg, hold)
+		if err != nil {
+			return nil, err
+		}
+		http.AddReadinessCheck("controllers", bk.observer.Ready)
+		return []*backup{bk}, nil
+	}
+
+	var backups []*backup
+	for _, cl := range clusters {
+		check := "controllers/" + cl.Name
+		rest, err := cl.client()
+		if err != nil {
+			err = fmt.Errorf("failed to create a client for cluster %s: %v", cl.Name, err)
+			logger.Error(err)
+			http.AddReadinessCheck(check, func() error { return err })
+			continue
+		}
+
+		bk, err := startBackup(logger, repo, fact, paths, cl.Name, filepath.Join(localDir, cl.Name), rest, hold)
+		if err != nil {
+			err = fmt.Errorf("failed to start cluster %s backup: %v", cl.Name, err)
+			logger.Error(err)
+			http.AddReadinessCheck(check, func() error { return err })
+			continue
+		}
+
+		http.AddReadinessCheck(check, bk.observer.Ready)
+		backups = append(backups, bk)
+	}
+
+	if len(backups) == 0 {
+		return nil, fmt.Errorf("no cluster could be started")
+	}
+
+	return backups, nil
+}
+
+func startBackup(logger *logrus.Logger, repo store.Backend, fact observer.ControllerFactory,
+	paths *recorder.Layout, name, dir string, rest client.Interface, hold bool) (*backup, error) {
+
+	var changes store.Changelog
+	if cl, ok := repo.(store.Changelog); ok {
+		changes = cl
+		if name != "" {
+			changes = &clusterChanges{cluster: name, changes: cl}
+		}
+	}
+
+	evts := event.New()
+	reco := recorder.New(logger, evts, changes, dir, paths, resyncInt*2, dryRun, name)
+	if hold {
+		// the directory is created, and files migrated, once released
+		reco.Hold()
+	} else {
+		err := appFs.MkdirAll(filepath.Clean(dir), 0700)
+		if err != nil {
+			return nil, fmt.Errorf("can't create directory %s: %v", dir, err)
+		}
+
+		mover, _ := repo.(store.Mover)
+		if err = reco.Migrate(mover); err != nil {
+			return nil, fmt.Errorf("failed to migrate files to the %q layout: %v", layout, err)
+		}
+	}
+
+	return &backup{
+		name:     name,
+		recorder: reco.Start(),
+		observer: observer.New(logger, rest, evts, fact, exclkind, namespace, name).Start(),
+	}, nil
+}
+
+// Stop halts the cluster's controllers, then its recorder
+func (b *backup) Stop() {
+	b.observer.Stop()
+	b.recorder.Stop()
+}
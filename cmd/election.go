@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/bpineau/katafygio/pkg/client"
+	"github.com/bpineau/katafygio/pkg/election"
+)
+
+// saNamespaceFile holds the pod's namespace, when running in a cluster
+const saNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// startElection campaigns for the leader election lease. In multi-cluster
+// mode, the lease lives in the default (global settings) cluster.
+func startElection(logger *logrus.Logger) (*election.Elector, error) {
+	rest := restcfg
+	if rest == nil {
+		var err error
+		rest, err = client.New(apiServer, context, kubeConf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create a leader election client: %v", err)
+		}
+	}
+
+	clientset, err := kubernetes.NewForConfig(rest.GetRestConfig())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a leader election client: %v", err)
+	}
+
+	identity, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get our hostname, for leader election: %v", err)
+	}
+
+	elector := election.New(logger, clientset, leaseNamespace(), leaseName, identity)
+	elector.LeaseDuration = leaseDuration
+	elector.RenewDeadline = renewDeadline
+	elector.RetryPeriod = retryPeriod
+
+	return elector.Start()
+}
+
+// leaseNamespace defaults to the pod's namespace
+func leaseNamespace() string {
+	if leaseNS != "" {
+		return leaseNS
+	}
+
+	ns, err := afero.ReadFile(appFs, saNamespaceFile)
+	if err == nil && len(strings.TrimSpace(string(ns))) > 0 {
+		return strings.TrimSpace(string(ns))
+	}
+
+	return "default"
+}
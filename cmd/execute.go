@@ -6,19 +6,27 @@ import (
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"syscall"
 
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 
+	"github.com/bpineau/katafygio/pkg/audit"
 	"github.com/bpineau/katafygio/pkg/client"
 	"github.com/bpineau/katafygio/pkg/controller"
-	"github.com/bpineau/katafygio/pkg/event"
+	"github.com/bpineau/katafygio/pkg/crypt"
+	"github.com/bpineau/katafygio/pkg/election"
+	"github.com/bpineau/katafygio/pkg/format"
 	"github.com/bpineau/katafygio/pkg/health"
 	"github.com/bpineau/katafygio/pkg/log"
-	"github.com/bpineau/katafygio/pkg/observer"
+	"github.com/bpineau/katafygio/pkg/metrics"
 	"github.com/bpineau/katafygio/pkg/recorder"
+	"github.com/bpineau/katafygio/pkg/store"
+	"github.com/bpineau/katafygio/pkg/store/dir"
 	"github.com/bpineau/katafygio/pkg/store/git"
+	"github.com/bpineau/katafygio/pkg/store/s3"
 )
 
 const appName = "katafygio"
@@ -48,7 +56,11 @@ func runE(cmd *cobra.Command, args []string) (err error) {
 	}
 	logger.Info(appName, " starting")
 
-	if restcfg == nil {
+	if err = checkClusters(clusters); err != nil {
+		return err
+	}
+
+	if restcfg == nil && len(clusters) == 0 {
 		restcfg, err = client.New(apiServer, context, kubeConf)
 		if err != nil {
 			return fmt.Errorf("failed to create a client: %v", err)
@@ -60,16 +72,30 @@ func runE(cmd *cobra.Command, args []string) (err error) {
 		return fmt.Errorf("can't create directory %s: %v", localDir, err)
 	}
 
-	http := health.New(logger, healthP).Start()
+	http := health.New(logger, healthP).Handle("/metrics", metrics.Handler())
 
-	var repo *git.Store
-	if !noGit {
-		repo, err = git.New(logger, dryRun, localDir, gitURL, gitTimeout).Start()
-	}
-	if err != nil {
-		return fmt.Errorf("failed to start git repo handler: %v", err)
+	var auditor git.Auditor
+	if auditWebhook {
+		if healthP == 0 {
+			return fmt.Errorf("the audit webhook requires a healthcheck-port")
+		}
+		if len(clusters) > 0 {
+			return fmt.Errorf("the audit webhook isn't supported with several clusters")
+		}
+		if auditTokenFile == "" {
+			return fmt.Errorf("the audit webhook requires an audit-webhook-token-file")
+		}
+		token, err := readSecret(auditTokenFile)
+		if err != nil {
+			return err
+		}
+		auditLog := audit.New(logger, restcfg, token)
+		http.Handle("/audit", auditLog)
+		auditor = auditLog
 	}
 
+	http.Start()
+
 	exclnsre := make([]*regexp.Regexp, 0, len(exclnamespaces))
 	for _, ns := range exclnamespaces {
 		exclnsre = append(exclnsre, regexp.MustCompile(ns))
@@ -81,31 +107,264 @@ func runE(cmd *cobra.Command, args []string) (err error) {
 		NoOwnerRef: noOwnerRef,
 	}
 
-	evts := event.New()
-	fact := controller.NewFactory(logger, selector, resyncInt, exclusions)
-	reco := recorder.New(logger, evts, localDir, resyncInt*2, dryRun).Start()
-	obsv := observer.New(logger, restcfg, evts, fact, exclkind, namespace).Start()
+	output, err := format.Parse(outputFormat)
+	if err != nil {
+		return err
+	}
+
+	paths, err := recorder.NewLayout(layout, output, legacyNames)
+	if err != nil {
+		return err
+	}
+
+	stripper, err := controller.NewStripper(stripRules)
+	if err != nil {
+		return fmt.Errorf("failed to parse strip-rules: %v", err)
+	}
+
+	var transformers []controller.Transformer
+	if applyReady {
+		norm, err := controller.NewNormalizer(applyDefaults)
+		if err != nil {
+			return fmt.Errorf("failed to parse apply-ready-defaults: %v", err)
+		}
+		transformers = append(transformers, norm)
+	}
+
+	if encryptKey != "" {
+		if encryptDataKey == "" {
+			encryptDataKey = filepath.Clean(localDir) + ".data-key"
+		}
+		enc, err := crypt.NewEncrypter(encryptKey, encryptDataKey, encryptKinds)
+		if err != nil {
+			return fmt.Errorf("failed to create an encrypter: %v", err)
+		}
+		transformers = append(transformers, enc)
+	}
+
+	fact := controller.NewFactory(logger, selector, resyncInt, exclusions, stripper, output, transformers...)
 
-	logger.Info(appName, " started")
 	sigterm := make(chan os.Signal, 1)
 	signal.Notify(sigterm, syscall.SIGTERM)
 	signal.Notify(sigterm, syscall.SIGINT)
-	if !dumpMode {
-		<-sigterm
+
+	repo, err := newStore(logger, auditor)
+	if err != nil {
+		return fmt.Errorf("failed to create %s storage backend: %v", storeDriver, err)
+	}
+
+	// standbys run their controllers (so they're warm), but only the leader
+	// starts the store and lets the recorders write to the local directory
+	var elector *election.Elector
+	if leaderElect {
+		if elector, err = startElection(logger); err != nil {
+			return err
+		}
+		defer elector.Stop()
+	} else if err = startStore(http, repo); err != nil {
+		return err
+	}
+
+	backups, err := startBackups(logger, http, repo, fact, paths, leaderElect)
+	if err != nil {
+		return err
+	}
+
+	var lost <-chan struct{}
+	if leaderElect {
+		logger.Info(appName, " standing by until elected leader")
+		select {
+		case <-elector.Leading():
+			err = lead(http, repo, backups)
+		case <-sigterm:
+			for _, bk := range backups {
+				bk.Stop()
+			}
+			http.Stop()
+			logger.Info(appName, " stopped")
+			return nil
+		}
+		lost = elector.Lost()
+	}
+
+	if err == nil {
+		logger.Info(appName, " started")
+	}
+	if err == nil && !dumpMode {
+		select {
+		case <-sigterm:
+		case <-lost:
+			// an other replica may be leading already: exit (to be restarted as a standby)
+			err = fmt.Errorf("lost the leader election lease")
+		}
 	}
 
 	logger.Info(appName, " stopping")
-	obsv.Stop()
-	reco.Stop()
+	if err != nil {
+		// stop pushing before anything else, as we're not the leader anymore
+		repo.Stop()
+	}
+	for _, bk := range backups {
+		bk.Stop()
+	}
 	http.Stop()
-	if !noGit {
+	if dumpMode && err == nil {
+		syncStore(logger, repo)
+	}
+	if err == nil {
 		repo.Stop()
 	}
 	logger.Info(appName, " stopped")
 
+	return err
+}
+
+func newStore(logger *logrus.Logger, auditor git.Auditor) (store.Backend, error) {
+	if noGit {
+		storeDriver = "dir"
+	}
+
+	switch storeDriver {
+	case "git":
+		repo := git.New(logger, dryRun, localDir, gitURL, gitTimeout)
+		repo.Driver = gitDriver
+		repo.Branch = gitBranch
+		repo.ConflictStrategy = gitConflict
+		repo.ConflictBranch = gitSideBranch
+		repo.SnapshotSchedule = snapSchedule
+		repo.SnapshotKeepHourly = snapHourly
+		repo.SnapshotKeepDaily = snapDaily
+		repo.SnapshotKeepMonthly = snapMonthly
+		repo.QuietPeriod = quietPeriod
+		repo.MaxBatchWindow = batchWindow
+		repo.MaxCommitsPerHour = commitsPerHour
+		repo.FullCheckInterval = fullCheck
+		repo.Auditor = auditor
+		repo.SSHKeyFile = gitSSHKey
+		repo.KnownHostsFile = gitKnownHosts
+		repo.StrictHostKey = gitStrictHost
+		repo.Username = gitUsername
+		repo.Token = gitToken
+		repo.SigningKey = gitSignKey
+		repo.Author = gitName
+		repo.Email = gitEmail
+
+		for _, pattern := range gitRedact {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid git-redact-patterns %q: %v", pattern, err)
+			}
+			repo.RedactPatterns = append(repo.RedactPatterns, re)
+		}
+
+		var err error
+		if gitPassFile != "" {
+			if repo.SSHPassphrase, err = readSecret(gitPassFile); err != nil {
+				return nil, err
+			}
+		}
+		if gitSignPass != "" {
+			if repo.SigningPassphrase, err = readSecret(gitSignPass); err != nil {
+				return nil, err
+			}
+		}
+		if gitTokenFile != "" {
+			if repo.Token, err = readSecret(gitTokenFile); err != nil {
+				return nil, err
+			}
+		}
+
+		return repo, nil
+	case "s3":
+		return s3.New(logger, dryRun, localDir, s3Endpoint, s3Bucket, s3Prefix, s3Region,
+			s3AccessKey, s3SecretKey, gitTimeout), nil
+	case "dir":
+		return dir.New(logger, localDir), nil
+	}
+
+	return nil, fmt.Errorf("unknown storage backend")
+}
+
+// startStore clones (or fetches) the store content, and starts its background
+// synchronization. In dump mode, the changes are only committed and pushed
+// once (see syncStore), without a background synchronization racing with us.
+func startStore(http *health.Listener, repo store.Backend) error {
+	var err error
+	switch r := repo.(type) {
+	case *git.Store:
+		if dumpMode {
+			err = r.CloneOrInit()
+		} else {
+			_, err = r.Start()
+		}
+	case *s3.Store:
+		if dumpMode {
+			err = r.Fetch()
+		} else {
+			_, err = r.Start()
+		}
+	case *dir.Store:
+		_, err = r.Start()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to start %s storage backend: %v", storeDriver, err)
+	}
+
+	if hc, ok := repo.(store.Health); ok {
+		http.AddLivenessCheck("store", hc.Alive).AddReadinessCheck("store", hc.Ready)
+	}
+
+	return nil
+}
+
+// lead starts the store, then lets the (held) recorders write to the local
+// directory, once we're elected leader
+func lead(http *health.Listener, repo store.Backend, backups []*backup) error {
+	if err := startStore(http, repo); err != nil {
+		return err
+	}
+
+	mover, _ := repo.(store.Mover)
+	for _, bk := range backups {
+		if err := bk.recorder.Release(mover); err != nil {
+			return fmt.Errorf("failed to migrate files to the %q layout: %v", layout, err)
+		}
+	}
+
 	return nil
 }
 
+// readSecret reads a secret (ie. a token) from a file
+func readSecret(path string) (string, error) {
+	data, err := afero.ReadFile(appFs, path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	return strings.TrimSpace(string(data)), nil
+}
+
+// syncStore flushes the latest changes, in dump mode (where the store doesn't
+// synchronize in the background). Previous commits are pushed even when
+// nothing changed, in case an earlier push failed.
+func syncStore(logger *logrus.Logger, repo store.Backend) {
+	_, err := repo.Commit()
+	if err != nil {
+		logger.Errorf("failed to commit changes: %v", err)
+	}
+
+	if rec, ok := repo.(store.Reconciler); ok {
+		if err = rec.Reconcile(); err != nil {
+			logger.Errorf("failed to reconcile with the remote: %v", err)
+			return
+		}
+	}
+
+	if err = repo.Push(); err != nil {
+		logger.Errorf("failed to push changes: %v", err)
+	}
+}
+
 // Execute adds all child commands to the root command and sets their flags.
 func Execute() error {
 	return RootCmd.Execute()
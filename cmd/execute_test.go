@@ -2,10 +2,25 @@ package cmd
 
 import (
 	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/afero"
 	"k8s.io/client-go/rest"
+
+	"github.com/bpineau/katafygio/pkg/controller"
+	"github.com/bpineau/katafygio/pkg/event"
+	"github.com/bpineau/katafygio/pkg/format"
+	"github.com/bpineau/katafygio/pkg/health"
+	"github.com/bpineau/katafygio/pkg/recorder"
+	dirstore "github.com/bpineau/katafygio/pkg/store/dir"
+	"github.com/bpineau/katafygio/pkg/store/git"
 )
 
 type mockClient struct{}
@@ -52,3 +67,267 @@ func TestVersionCmd(t *testing.T) {
 		t.Errorf("version subcommand shouldn't fail: %+v", err)
 	}
 }
+
+func TestRestoreCmd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "katafygio-tests")
+	if err != nil {
+		t.Fatal("failed to create a temp dir for tests")
+	}
+	defer os.RemoveAll(dir)
+
+	restcfg = new(mockClient)
+	RootCmd.SetOutput(new(bytes.Buffer))
+	RootCmd.SetArgs([]string{
+		"restore",
+		"--config",
+		"/dev/null",
+		"--local-dir",
+		dir,
+		"--log-output",
+		"test",
+	})
+
+	if err := RootCmd.Execute(); err != nil {
+		t.Errorf("restore subcommand shouldn't fail on an empty dump: %+v", err)
+	}
+}
+
+func TestRestoredCluster(t *testing.T) {
+	defer func() { clusters, restoreCluster = nil, "" }()
+
+	tests := []struct {
+		clusters []clusterConfig
+		selected string
+		expected string
+	}{
+		{[]clusterConfig{{Name: "prod"}}, "", "prod"},
+		{[]clusterConfig{{Name: "prod"}, {Name: "staging"}}, "staging", "staging"},
+		{[]clusterConfig{{Name: "prod"}, {Name: "staging"}}, "", ""},
+		{[]clusterConfig{{Name: "prod"}}, "dev", ""},
+		{nil, "prod", ""},
+	}
+
+	for _, tt := range tests {
+		clusters, restoreCluster = tt.clusters, tt.selected
+		cl, err := restoredCluster()
+		if tt.expected == "" && err == nil {
+			t.Errorf("%v, %q: restore should refuse an ambiguous or unknown cluster", tt.clusters, tt.selected)
+		}
+		if tt.expected != "" && (err != nil || cl.Name != tt.expected) {
+			t.Errorf("%v, %q: expected cluster %s, got %v (%v)", tt.clusters, tt.selected, tt.expected, cl, err)
+		}
+	}
+}
+
+func TestCheckClusters(t *testing.T) {
+	tests := []struct {
+		clusters []clusterConfig
+		valid    bool
+	}{
+		{nil, true},
+		{[]clusterConfig{{Name: "prod"}, {Name: "staging", Context: "stg"}}, true},
+		{[]clusterConfig{{Name: ""}}, false},
+		{[]clusterConfig{{Name: ".."}}, false},
+		{[]clusterConfig{{Name: ".git"}}, false},
+		{[]clusterConfig{{Name: "eu/prod"}}, false},
+		{[]clusterConfig{{Name: "prod"}, {Name: "prod"}}, false},
+	}
+
+	for _, tt := range tests {
+		if err := checkClusters(tt.clusters); (err == nil) != tt.valid {
+			t.Errorf("checkClusters(%v) error = %v, expected valid: %v", tt.clusters, err, tt.valid)
+		}
+	}
+}
+
+func TestStartBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "katafygio-tests")
+	if err != nil {
+		t.Fatal("failed to create a temp dir for tests")
+	}
+	defer os.RemoveAll(dir)
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	paths, _ := recorder.NewLayout("", format.YAML, false)
+	fact := controller.NewFactory(logger, "", 60, &controller.Exclusions{}, nil, format.YAML)
+	named := func(name string, cfg clusterConfig) clusterConfig {
+		cfg.Name = name
+		return cfg
+	}
+	reachable := clusterConfig{APIServer: "http://127.0.0.1:1", KubeConfig: "/dev/null"}
+	broken := clusterConfig{KubeConfig: dir + "/missing"}
+
+	localDir, restcfg = dir, new(mockClient)
+	defer func() { clusters, restcfg = nil, nil }()
+
+	tests := []struct {
+		clusters []clusterConfig
+		started  []string
+		fails    bool
+	}{
+		{nil, []string{""}, false},
+		{[]clusterConfig{named("prod", reachable), named("staging", reachable)}, []string{"prod", "staging"}, false},
+		{[]clusterConfig{named("prod", reachable), named("staging", broken), named("dev", reachable)}, []string{"prod", "dev"}, false},
+		{[]clusterConfig{named("staging", broken)}, nil, true},
+	}
+
+	for _, tt := range tests {
+		clusters = tt.clusters
+		backups, err := startBackups(logger, health.New(logger, 0), dirstore.New(logger, dir), fact, paths, false)
+		if (err != nil) != tt.fails {
+			t.Errorf("%v: expected failure: %v, got %v", tt.clusters, tt.fails, err)
+		}
+
+		var started []string
+		for _, bk := range backups {
+			started = append(started, bk.name)
+			bk.Stop()
+		}
+		if strings.Join(started, ",") != strings.Join(tt.started, ",") {
+			t.Errorf("%v: expected %v clusters backups to start, got %v", tt.clusters, tt.started, started)
+		}
+	}
+}
+
+func TestLeaseNamespace(t *testing.T) {
+	appFs = afero.NewMemMapFs()
+	leaseNS = ""
+	if ns := leaseNamespace(); ns != "default" {
+		t.Errorf("lease namespace should default to \"default\" out of a cluster, got %q", ns)
+	}
+
+	_ = afero.WriteFile(appFs, saNamespaceFile, []byte("backups\n"), 0600)
+	if ns := leaseNamespace(); ns != "backups" {
+		t.Errorf("lease namespace should default to the pod's namespace, got %q", ns)
+	}
+
+	leaseNS = "kube-system"
+	defer func() { leaseNS = "" }()
+	if ns := leaseNamespace(); ns != "kube-system" {
+		t.Errorf("lease namespace should be configurable, got %q", ns)
+	}
+}
+
+type mockStore struct {
+	calls     []string
+	changed   bool
+	reconcile error
+}
+
+func (m *mockStore) Commit() (bool, error) {
+	m.calls = append(m.calls, "commit")
+	return m.changed, nil
+}
+
+func (m *mockStore) Reconcile() error {
+	m.calls = append(m.calls, "reconcile")
+	return m.reconcile
+}
+
+func (m *mockStore) Push() error {
+	m.calls = append(m.calls, "push")
+	return nil
+}
+
+func (m *mockStore) Stop() {}
+
+func TestSyncStore(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	repo := &mockStore{changed: true}
+	syncStore(logger, repo)
+	if calls := strings.Join(repo.calls, ","); calls != "commit,reconcile,push" {
+		t.Errorf("changes should be reconciled with the remote before pushing, got %s", calls)
+	}
+
+	// previous commits are pushed even without new changes
+	repo = &mockStore{changed: false}
+	syncStore(logger, repo)
+	if calls := strings.Join(repo.calls, ","); calls != "commit,reconcile,push" {
+		t.Errorf("pending commits should be pushed even without new changes, got %s", calls)
+	}
+
+	repo = &mockStore{reconcile: errors.New("conflict")}
+	syncStore(logger, repo)
+	if calls := strings.Join(repo.calls, ","); calls != "commit,reconcile" {
+		t.Errorf("changes shouldn't be pushed when reconciliation failed, got %s", calls)
+	}
+}
+
+func TestDumpModeStore(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found, skipping")
+	}
+
+	dir, err := ioutil.TempDir("", "katafygio-tests")
+	if err != nil {
+		t.Fatal("failed to create a temp dir for tests")
+	}
+	defer os.RemoveAll(dir)
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	defer func(interval time.Duration) { git.CheckInterval = interval }(git.CheckInterval)
+	git.CheckInterval = 10 * time.Millisecond
+
+	noGit, dumpMode, dryRun = false, true, false
+	storeDriver, gitDriver, localDir, gitURL = "git", git.DriverExec, dir, ""
+	defer func() { dumpMode = false }()
+
+	repo, err := newStore(logger, nil)
+	if err != nil {
+		t.Fatalf("failed to create a dump mode store: %v", err)
+	}
+	if err = startStore(health.New(logger, 0), repo); err != nil {
+		t.Fatalf("failed to start a dump mode store: %v", err)
+	}
+
+	// the final flush mustn't race with a background synchronization
+	_ = ioutil.WriteFile(dir+"/t.yaml", []byte("foo"), 0600)
+	time.Sleep(100 * time.Millisecond)
+	out, err := exec.Command("git", "-C", dir, "status", "--porcelain").Output() // #nosec
+	if err != nil || len(out) == 0 {
+		t.Errorf("a dump mode store shouldn't commit in the background (%v)", err)
+	}
+
+	syncStore(logger, repo)
+	repo.Stop()
+
+	out, err = exec.Command("git", "-C", dir, "status", "--porcelain").Output() // #nosec
+	if err != nil || len(out) != 0 {
+		t.Errorf("the final flush should commit the dump, got %q (%v)", out, err)
+	}
+}
+
+func TestLead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "katafygio-tests")
+	if err != nil {
+		t.Fatal("failed to create a temp dir for tests")
+	}
+	defer os.RemoveAll(dir)
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+
+	paths, _ := recorder.NewLayout("", format.YAML, false)
+	evts := event.New()
+	bk := &backup{recorder: recorder.New(logger, evts, nil, dir+"/dump", paths, 120, false, "").Hold().Start()}
+	defer bk.recorder.Stop()
+
+	evts.Send(&event.Notification{Action: event.Upsert, Key: "foo", Kind: "configmap", Object: []byte("bar")})
+	if _, err = os.Stat(dir + "/dump"); !os.IsNotExist(err) {
+		t.Error("standbys shouldn't write to the local directory")
+	}
+
+	if err = lead(health.New(logger, 0), dirstore.New(logger, dir+"/dump"), []*backup{bk}); err != nil {
+		t.Fatalf("failed to lead: %v", err)
+	}
+
+	if _, err = os.Stat(dir + "/dump/configmap-foo.yaml"); err != nil {
+		t.Errorf("the objects seen while standing by should be written once leading (%v)", err)
+	}
+}
@@ -2,8 +2,13 @@ package cmd
 
 import (
 	"log"
+	"os"
 	"time"
 
+	"github.com/bpineau/katafygio/pkg/controller"
+	"github.com/bpineau/katafygio/pkg/election"
+	"github.com/bpineau/katafygio/pkg/store/git"
+
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -23,13 +28,66 @@ var (
 	selector       string
 	localDir       string
 	gitURL         string
+	gitBranch      string
+	gitConflict    string
+	gitSideBranch  string
+	snapSchedule   string
+	snapHourly     int
+	snapDaily      int
+	snapMonthly    int
+	quietPeriod    time.Duration
+	batchWindow    time.Duration
+	commitsPerHour int
+	fullCheck      time.Duration
+	gitSSHKey      string
+	gitPassFile    string
+	gitKnownHosts  string
+	gitStrictHost  bool
+	gitUsername    string
+	gitTokenFile   string
+	gitToken       string
+	gitRedact      []string
+	gitSignKey     string
+	gitSignPass    string
+	gitName        string
+	gitEmail       string
 	gitTimeout     time.Duration
+	gitDriver      string
 	healthP        int
+	auditWebhook   bool
+	auditTokenFile string
+	leaderElect    bool
+	leaseNS        string
+	leaseName      string
+	leaseDuration  time.Duration
+	renewDeadline  time.Duration
+	retryPeriod    time.Duration
 	resyncInt      int
 	exclkind       []string
 	exclobj        []string
 	noGit          bool
+	storeDriver    string
+	s3Endpoint     string
+	s3Bucket       string
+	s3Prefix       string
+	s3Region       string
+	s3AccessKey    string
+	s3SecretKey    string
 	noOwnerRef     bool
+	encryptKey     string
+	encryptKinds   []string
+	encryptDataKey string
+	stripRules     []controller.StripRule
+	applyReady     bool
+	applyDefaults  []controller.DefaultValue
+	outputFormat   string
+	layout         string
+	legacyNames    bool
+	clusters       []clusterConfig
+	restoreRev     string
+	restoreForce   bool
+	restoreCluster string
+	decryptKey     string
 )
 
 func bindPFlag(key string, cmd string) {
@@ -41,6 +99,7 @@ func bindPFlag(key string, cmd string) {
 func init() {
 	cobra.OnInitialize(loadConfigFile)
 	RootCmd.AddCommand(versionCmd)
+	RootCmd.AddCommand(restoreCmd)
 
 	defaultCfg := "/etc/katafygio/" + appName + ".yaml"
 	RootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", defaultCfg, "Configuration file")
@@ -81,9 +140,78 @@ func init() {
 	RootCmd.PersistentFlags().StringVarP(&gitURL, "git-url", "g", "", "Git repository URL")
 	bindPFlag("git-url", "git-url")
 
-	RootCmd.PersistentFlags().DurationVarP(&gitTimeout, "git-timeout", "t", 300*time.Second, "Git operations timeout")
+	RootCmd.PersistentFlags().StringVar(&gitBranch, "git-branch", "", "Git branch to commit to (created when missing). Default: the cloned branch")
+	bindPFlag("git-branch", "git-branch")
+
+	RootCmd.PersistentFlags().StringVar(&gitConflict, "git-conflict-strategy", git.ConflictMerge, "How to reconcile diverged histories: merge, rebase, reset or side-branch")
+	bindPFlag("git-conflict-strategy", "git-conflict-strategy")
+
+	RootCmd.PersistentFlags().StringVar(&gitSideBranch, "git-conflict-branch", "", "Branch receiving local commits with the side-branch strategy. Default: katafygio/diverged/<branch>")
+	bindPFlag("git-conflict-branch", "git-conflict-branch")
+
+	RootCmd.PersistentFlags().StringVar(&snapSchedule, "git-snapshot-schedule", "", "Cron-like schedule (ie. '0 * * * *', or '@monthly') for snapshot tags")
+	bindPFlag("git-snapshot-schedule", "git-snapshot-schedule")
+
+	RootCmd.PersistentFlags().IntVar(&snapHourly, "git-snapshot-keep-hourly", 0, "Number of hourly snapshot tags to keep")
+	bindPFlag("git-snapshot-keep-hourly", "git-snapshot-keep-hourly")
+
+	RootCmd.PersistentFlags().IntVar(&snapDaily, "git-snapshot-keep-daily", 0, "Number of daily snapshot tags to keep")
+	bindPFlag("git-snapshot-keep-daily", "git-snapshot-keep-daily")
+
+	RootCmd.PersistentFlags().IntVar(&snapMonthly, "git-snapshot-keep-monthly", 0, "Number of monthly snapshot tags to keep (all snapshots are kept when no retention is set)")
+	bindPFlag("git-snapshot-keep-monthly", "git-snapshot-keep-monthly")
+
+	RootCmd.PersistentFlags().DurationVar(&quietPeriod, "git-quiet-period", 0, "Commit once no change happened for that long (ie. '1m')")
+	bindPFlag("git-quiet-period", "git-quiet-period")
+
+	RootCmd.PersistentFlags().DurationVar(&batchWindow, "git-max-batch-window", 0, "Commit changes waiting for a quiet period for that long (ie. '10m')")
+	bindPFlag("git-max-batch-window", "git-max-batch-window")
+
+	RootCmd.PersistentFlags().IntVar(&commitsPerHour, "git-max-commits-per-hour", 0, "Maximum number of commits per hour (0 for no limit)")
+	bindPFlag("git-max-commits-per-hour", "git-max-commits-per-hour")
+
+	RootCmd.PersistentFlags().DurationVar(&fullCheck, "git-full-check-interval", 0, "Interval between full scans of the local directory, catching changes not made by katafygio (0: at start only)")
+	bindPFlag("git-full-check-interval", "git-full-check-interval")
+
+	RootCmd.PersistentFlags().StringVar(&gitSSHKey, "git-ssh-key", "", "SSH private key file, for ssh git urls")
+	bindPFlag("git-ssh-key", "git-ssh-key")
+
+	RootCmd.PersistentFlags().StringVar(&gitPassFile, "git-ssh-passphrase-file", "", "File holding the SSH private key passphrase")
+	bindPFlag("git-ssh-passphrase-file", "git-ssh-passphrase-file")
+
+	RootCmd.PersistentFlags().StringVar(&gitKnownHosts, "git-known-hosts", "", "SSH known_hosts file (default: the user's known_hosts)")
+	bindPFlag("git-known-hosts", "git-known-hosts")
+
+	RootCmd.PersistentFlags().BoolVar(&gitStrictHost, "git-strict-host-key-checking", true, "Refuse SSH hosts missing from known_hosts")
+	bindPFlag("git-strict-host-key-checking", "git-strict-host-key-checking")
+
+	RootCmd.PersistentFlags().StringVar(&gitUsername, "git-username", "git", "Username for https git urls, used with the token")
+	bindPFlag("git-username", "git-username")
+
+	RootCmd.PersistentFlags().StringVar(&gitTokenFile, "git-token-file", "", "File holding the token (password) for https git urls (default from $KF_GIT_TOKEN)")
+	bindPFlag("git-token-file", "git-token-file")
+
+	RootCmd.PersistentFlags().StringSliceVar(&gitRedact, "git-redact-patterns", nil, "Regexes matching secrets to mask from git errors and logs (urls credentials are always masked)")
+	bindPFlag("git-redact-patterns", "git-redact-patterns")
+
+	RootCmd.PersistentFlags().StringVar(&gitSignKey, "git-signing-key", "", "Sign commits with this armored GPG, or SSH, private key file")
+	bindPFlag("git-signing-key", "git-signing-key")
+
+	RootCmd.PersistentFlags().StringVar(&gitSignPass, "git-signing-passphrase-file", "", "File holding the signing key passphrase")
+	bindPFlag("git-signing-passphrase-file", "git-signing-passphrase-file")
+
+	RootCmd.PersistentFlags().StringVar(&gitName, "git-committer-name", git.GitAuthor, "Commits committer (and signer) name")
+	bindPFlag("git-committer-name", "git-committer-name")
+
+	RootCmd.PersistentFlags().StringVar(&gitEmail, "git-committer-email", git.GitEmail, "Commits committer (and signer) email")
+	bindPFlag("git-committer-email", "git-committer-email")
+
+	RootCmd.PersistentFlags().DurationVarP(&gitTimeout, "git-timeout", "t", 300*time.Second, "Git (or s3) operations timeout")
 	bindPFlag("git-timeout", "git-timeout")
 
+	RootCmd.PersistentFlags().StringVar(&gitDriver, "git-driver", "exec", "Git implementation: exec (git command) or native (built-in)")
+	bindPFlag("git-driver", "git-driver")
+
 	RootCmd.PersistentFlags().StringSliceVarP(&exclkind, "exclude-kind", "x", nil, "Ressource kind to exclude. Eg. 'deployment'")
 	bindPFlag("exclude-kind", "exclude-kind")
 
@@ -93,17 +221,88 @@ func init() {
 	RootCmd.PersistentFlags().BoolVarP(&noOwnerRef, "exclude-having-owner-ref", "w", false, "Exclude all objects having an Owner Reference")
 	bindPFlag("exclude-having-owner-ref", "exclude-having-owner-ref")
 
+	RootCmd.PersistentFlags().StringVarP(&outputFormat, "output-format", "O", "yaml", "Dump format: yaml, json, or multidoc (one multi-document yaml file per namespace)")
+	bindPFlag("output-format", "output-format")
+
+	RootCmd.PersistentFlags().StringVarP(&layout, "layout", "L", "", "Files layout template, ie. '{{.Namespace}}/{{.QualifiedKind}}/{{.Name}}.yaml' (default '<namespace>/<kind>.<group>-<name>.yaml')")
+	bindPFlag("layout", "layout")
+
+	RootCmd.PersistentFlags().BoolVar(&legacyNames, "legacy-filenames", false, "Don't qualify files names with the objects API group (kinds sharing a name may collide)")
+	bindPFlag("legacy-filenames", "legacy-filenames")
+
+	RootCmd.PersistentFlags().BoolVarP(&applyReady, "apply-ready", "A", false, "Remove server populated and defaulted fields, so dumps are ready to apply")
+	bindPFlag("apply-ready", "apply-ready")
+
 	RootCmd.PersistentFlags().StringVarP(&selector, "filter", "l", "", "Label selector. Select only objects matching the label")
 	bindPFlag("filter", "filter")
 
-	RootCmd.PersistentFlags().IntVarP(&healthP, "healthcheck-port", "p", 0, "Port for answering healthchecks on /health url")
+	RootCmd.PersistentFlags().IntVarP(&healthP, "healthcheck-port", "p", 0, "Port for answering healthchecks on /healthz and /readyz urls, and serving prometheus /metrics")
 	bindPFlag("healthcheck-port", "healthcheck-port")
 
+	RootCmd.PersistentFlags().BoolVar(&auditWebhook, "audit-webhook", false, "Receive API server audit events on /audit (at healthcheck-port) to attribute changes")
+	bindPFlag("audit-webhook", "audit-webhook")
+
+	RootCmd.PersistentFlags().StringVar(&auditTokenFile, "audit-webhook-token-file", "", "File holding the bearer token audit events senders must present")
+	bindPFlag("audit-webhook-token-file", "audit-webhook-token-file")
+
+	RootCmd.PersistentFlags().BoolVar(&leaderElect, "leader-elect", false, "Elect a leader among replicas (using a Lease): only the leader dumps, commits and pushes")
+	bindPFlag("leader-elect", "leader-elect")
+
+	RootCmd.PersistentFlags().StringVar(&leaseNS, "leader-elect-namespace", "", "Leader election Lease namespace (default: the pod's namespace)")
+	bindPFlag("leader-elect-namespace", "leader-elect-namespace")
+
+	RootCmd.PersistentFlags().StringVar(&leaseName, "leader-elect-lease", appName, "Leader election Lease name")
+	bindPFlag("leader-elect-lease", "leader-elect-lease")
+
+	RootCmd.PersistentFlags().DurationVar(&leaseDuration, "leader-elect-lease-duration", election.LeaseDuration, "How long standbys wait before taking over a lease that wasn't renewed")
+	bindPFlag("leader-elect-lease-duration", "leader-elect-lease-duration")
+
+	RootCmd.PersistentFlags().DurationVar(&renewDeadline, "leader-elect-renew-deadline", election.RenewDeadline, "How long the leader retries renewing its lease before stepping down")
+	bindPFlag("leader-elect-renew-deadline", "leader-elect-renew-deadline")
+
+	RootCmd.PersistentFlags().DurationVar(&retryPeriod, "leader-elect-retry-period", election.RetryPeriod, "Interval between lease acquisition and renewal attempts")
+	bindPFlag("leader-elect-retry-period", "leader-elect-retry-period")
+
 	RootCmd.PersistentFlags().IntVarP(&resyncInt, "resync-interval", "i", 900, "Full resync interval in seconds (0 to disable)")
 	bindPFlag("resync-interval", "resync-interval")
 
-	RootCmd.PersistentFlags().BoolVarP(&noGit, "no-git", "n", false, "Don't version with git")
+	RootCmd.PersistentFlags().BoolVarP(&noGit, "no-git", "n", false, "Don't version with git (same as --store dir)")
 	bindPFlag("no-git", "no-git")
+
+	RootCmd.PersistentFlags().StringVarP(&storeDriver, "store", "S", "git", "Storage backend: git, s3, or dir (unversioned local directory)")
+	bindPFlag("store", "store")
+
+	RootCmd.PersistentFlags().StringVar(&s3Endpoint, "s3-endpoint", "https://s3.amazonaws.com", "S3 compatible endpoint url")
+	bindPFlag("s3-endpoint", "s3-endpoint")
+
+	RootCmd.PersistentFlags().StringVar(&s3Bucket, "s3-bucket", "", "S3 bucket name")
+	bindPFlag("s3-bucket", "s3-bucket")
+
+	RootCmd.PersistentFlags().StringVar(&s3Prefix, "s3-prefix", "", "S3 objects keys prefix")
+	bindPFlag("s3-prefix", "s3-prefix")
+
+	RootCmd.PersistentFlags().StringVar(&s3Region, "s3-region", "us-east-1", "S3 bucket region")
+	bindPFlag("s3-region", "s3-region")
+
+	RootCmd.PersistentFlags().StringVar(&s3AccessKey, "s3-access-key", os.Getenv("AWS_ACCESS_KEY_ID"), "S3 access key (default from $AWS_ACCESS_KEY_ID)")
+	bindPFlag("s3-access-key", "s3-access-key")
+
+	RootCmd.PersistentFlags().StringVar(&s3SecretKey, "s3-secret-key", "", "S3 secret key (default from $AWS_SECRET_ACCESS_KEY)")
+	bindPFlag("s3-secret-key", "s3-secret-key")
+
+	RootCmd.PersistentFlags().StringVarP(&encryptKey, "encrypt-key", "E", "", "Encrypt selected kinds' data with this PEM RSA public key")
+	bindPFlag("encrypt-key", "encrypt-key")
+
+	RootCmd.PersistentFlags().StringSliceVarP(&encryptKinds, "encrypt-kinds", "K", []string{"secret"}, "Kinds to encrypt, when using encrypt-key")
+	bindPFlag("encrypt-kinds", "encrypt-kinds")
+
+	RootCmd.PersistentFlags().StringVar(&encryptDataKey, "encrypt-data-key", "", "File keeping the data key across restarts, when using encrypt-key (default <local-dir>.data-key)")
+	bindPFlag("encrypt-data-key", "encrypt-data-key")
+
+	restoreCmd.Flags().StringVarP(&restoreRev, "revision", "R", "", "Restore objects as of this git revision, rather than the current local-dir content")
+	restoreCmd.Flags().BoolVarP(&restoreForce, "force-conflicts", "f", false, "Take ownership of fields managed by other actors")
+	restoreCmd.Flags().StringVarP(&decryptKey, "decrypt-key", "D", "", "PEM RSA private key used to decrypt encrypted objects")
+	restoreCmd.Flags().StringVar(&restoreCluster, "cluster", "", "Cluster to restore (from its local-dir subdirectory), when several are configured")
 }
 
 // for whatever the reason, viper don't auto bind values from config file so we have to tell him
@@ -121,11 +320,73 @@ func bindConf(cmd *cobra.Command, args []string) {
 	selector = viper.GetString("filter")
 	localDir = viper.GetString("local-dir")
 	gitURL = viper.GetString("git-url")
+	gitBranch = viper.GetString("git-branch")
+	gitConflict = viper.GetString("git-conflict-strategy")
+	gitSideBranch = viper.GetString("git-conflict-branch")
+	snapSchedule = viper.GetString("git-snapshot-schedule")
+	snapHourly = viper.GetInt("git-snapshot-keep-hourly")
+	snapDaily = viper.GetInt("git-snapshot-keep-daily")
+	snapMonthly = viper.GetInt("git-snapshot-keep-monthly")
+	quietPeriod = viper.GetDuration("git-quiet-period")
+	batchWindow = viper.GetDuration("git-max-batch-window")
+	commitsPerHour = viper.GetInt("git-max-commits-per-hour")
+	fullCheck = viper.GetDuration("git-full-check-interval")
+	gitSSHKey = viper.GetString("git-ssh-key")
+	gitPassFile = viper.GetString("git-ssh-passphrase-file")
+	gitKnownHosts = viper.GetString("git-known-hosts")
+	gitStrictHost = viper.GetBool("git-strict-host-key-checking")
+	gitUsername = viper.GetString("git-username")
+	gitTokenFile = viper.GetString("git-token-file")
+	gitToken = viper.GetString("git-token") // env or config file only, as args may leak
+	gitRedact = viper.GetStringSlice("git-redact-patterns")
+	gitSignKey = viper.GetString("git-signing-key")
+	gitSignPass = viper.GetString("git-signing-passphrase-file")
+	gitName = viper.GetString("git-committer-name")
+	gitEmail = viper.GetString("git-committer-email")
 	gitTimeout = viper.GetDuration("git-timeout")
+	gitDriver = viper.GetString("git-driver")
 	healthP = viper.GetInt("healthcheck-port")
+	auditWebhook = viper.GetBool("audit-webhook")
+	auditTokenFile = viper.GetString("audit-webhook-token-file")
+	leaderElect = viper.GetBool("leader-elect")
+	leaseNS = viper.GetString("leader-elect-namespace")
+	leaseName = viper.GetString("leader-elect-lease")
+	leaseDuration = viper.GetDuration("leader-elect-lease-duration")
+	renewDeadline = viper.GetDuration("leader-elect-renew-deadline")
+	retryPeriod = viper.GetDuration("leader-elect-retry-period")
 	resyncInt = viper.GetInt("resync-interval")
 	exclkind = viper.GetStringSlice("exclude-kind")
 	exclobj = viper.GetStringSlice("exclude-object")
 	noGit = viper.GetBool("no-git")
+	storeDriver = viper.GetString("store")
+	s3Endpoint = viper.GetString("s3-endpoint")
+	s3Bucket = viper.GetString("s3-bucket")
+	s3Prefix = viper.GetString("s3-prefix")
+	s3Region = viper.GetString("s3-region")
+	s3AccessKey = viper.GetString("s3-access-key")
+	s3SecretKey = viper.GetString("s3-secret-key")
+	if s3SecretKey == "" {
+		s3SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
 	noOwnerRef = viper.GetBool("exclude-having-owner-ref")
+	encryptKey = viper.GetString("encrypt-key")
+	encryptKinds = viper.GetStringSlice("encrypt-kinds")
+	encryptDataKey = viper.GetString("encrypt-data-key")
+
+	applyReady = viper.GetBool("apply-ready")
+	outputFormat = viper.GetString("output-format")
+	layout = viper.GetString("layout")
+	legacyNames = viper.GetBool("legacy-filenames")
+
+	// strip-rules, apply-ready-defaults and clusters are too structured
+	// for the command line: config file only
+	if err := viper.UnmarshalKey("strip-rules", &stripRules); err != nil {
+		log.Fatal("Failed to parse strip-rules:", err)
+	}
+	if err := viper.UnmarshalKey("apply-ready-defaults", &applyDefaults); err != nil {
+		log.Fatal("Failed to parse apply-ready-defaults:", err)
+	}
+	if err := viper.UnmarshalKey("clusters", &clusters); err != nil {
+		log.Fatal("Failed to parse clusters:", err)
+	}
 }
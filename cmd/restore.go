@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"github.com/bpineau/katafygio/pkg/client"
+	"github.com/bpineau/katafygio/pkg/crypt"
+	"github.com/bpineau/katafygio/pkg/log"
+	"github.com/bpineau/katafygio/pkg/restore"
+	"github.com/bpineau/katafygio/pkg/store/git"
+)
+
+var (
+	restoreCmd = &cobra.Command{
+		Use:   "restore",
+		Short: "Re-apply a dump to a cluster",
+		Long: "Re-apply the objects dumped in --local-dir (or in a given git revision\n" +
+			"of it) to a cluster, with server-side apply. CRDs and namespaces are\n" +
+			"restored first, then RBAC, then configurations, then workloads.",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PreRun:        bindConf,
+		RunE:          restoreE,
+	}
+)
+
+func restoreE(cmd *cobra.Command, args []string) (err error) {
+	logger, err := log.New(logLevel, logServer, logOutput)
+	if err != nil {
+		return fmt.Errorf("failed to create a logger: %v", err)
+	}
+
+	var cluster *clusterConfig
+	if len(clusters) > 0 || restoreCluster != "" {
+		if cluster, err = restoredCluster(); err != nil {
+			return err
+		}
+	}
+
+	if restcfg == nil {
+		if cluster != nil {
+			restcfg, err = cluster.client()
+		} else {
+			restcfg, err = client.New(apiServer, context, kubeConf)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create a client: %v", err)
+		}
+	}
+
+	var dec *crypt.Decrypter
+	if decryptKey != "" {
+		dec, err = crypt.NewDecrypter(decryptKey)
+		if err != nil {
+			return fmt.Errorf("failed to create a decrypter: %v", err)
+		}
+	}
+
+	dir := localDir
+	if restoreRev != "" {
+		dir, err = ioutil.TempDir("", appName+"-restore-")
+		if err != nil {
+			return fmt.Errorf("failed to create a temporary directory: %v", err)
+		}
+		defer os.RemoveAll(dir)
+
+		repo := git.New(logger, false, localDir, "", gitTimeout)
+		repo.Driver = gitDriver
+		err = repo.Archive(restoreRev, dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	src := localDir
+	if cluster != nil {
+		dir = filepath.Join(dir, cluster.Name)
+		src = filepath.Join(localDir, cluster.Name)
+	}
+
+	if restoreRev != "" {
+		logger.Infof("Restoring objects from %s at revision %s", src, restoreRev)
+	} else {
+		logger.Infof("Restoring objects from %s", src)
+	}
+
+	return restore.New(logger, restcfg, exclkind, dec, dryRun, restoreForce).Restore(dir)
+}
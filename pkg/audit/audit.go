@@ -0,0 +1,260 @@
+// Package audit receives Kubernetes API server audit events (sent by the
+// API server's audit webhook backend, as batched EventList payloads), and
+// remembers who last changed each object, and when.
+//
+// Those records are used to attribute the changes we commit to the actual
+// users, rather than to the field managers found in the objects metadata.
+package audit
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+
+	"github.com/bpineau/katafygio/pkg/event"
+)
+
+var (
+	// Retention is how long we remember an object's last change
+	Retention = time.Hour
+
+	// MaxPayloadSize caps the size of the audit payloads we'll accept
+	MaxPayloadSize int64 = 32 << 20
+
+	// RefreshInterval is the minimum interval between discovery cache
+	// refreshes, when audited resources are unknown
+	RefreshInterval = time.Minute
+
+	// changing verbs; we don't care about reads
+	verbs = map[string]bool{"create": true, "update": true, "patch": true, "delete": true}
+)
+
+type logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type restclient interface {
+	GetRestConfig() *rest.Config
+}
+
+type resettableMapper interface {
+	meta.RESTMapper
+	Reset()
+}
+
+// eventList is the subset of an audit.k8s.io/v1 EventList we need
+type eventList struct {
+	Kind  string       `json:"kind"`
+	Items []auditEvent `json:"items"`
+}
+
+type auditEvent struct {
+	Stage            string    `json:"stage"`
+	Verb             string    `json:"verb"`
+	User             userInfo  `json:"user"`
+	ImpersonatedUser *userInfo `json:"impersonatedUser,omitempty"`
+	ObjectRef        *struct {
+		Resource    string `json:"resource"`
+		Namespace   string `json:"namespace"`
+		Name        string `json:"name"`
+		APIGroup    string `json:"apiGroup"`
+		APIVersion  string `json:"apiVersion"`
+		Subresource string `json:"subresource"`
+	} `json:"objectRef,omitempty"`
+	ResponseStatus *struct {
+		Code int `json:"code"`
+	} `json:"responseStatus,omitempty"`
+	StageTimestamp time.Time `json:"stageTimestamp"`
+}
+
+type userInfo struct {
+	Username string `json:"username"`
+}
+
+// Log is an http handler receiving audit events, and keeping track of
+// objects last changes. Senders must present the token as a bearer token
+// (the audit webhook kubeconfig's user token).
+type Log struct {
+	logger  logger
+	token   string
+	lock    sync.RWMutex
+	records map[string]record // by "qualified-kind/namespace/name"
+
+	mapper     resettableMapper
+	mapperLock sync.Mutex // protect unknown and refreshed
+	unknown    map[schema.GroupVersionResource]error
+	refreshed  time.Time
+}
+
+type record struct {
+	audit    event.Audit
+	received time.Time
+}
+
+// New creates an audit Log. The client is used to map audited resources to
+// kinds, and the token authenticates the audit events senders.
+func New(log logger, client restclient, token string) *Log {
+	dc := discovery.NewDiscoveryClientForConfigOrDie(client.GetRestConfig())
+	return &Log{
+		logger:  log,
+		token:   token,
+		mapper:  restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(dc)),
+		unknown: make(map[schema.GroupVersionResource]error),
+		records: make(map[string]record),
+	}
+}
+
+// Audit returns the last known change of an object, or nil. The kind is
+// qualified by the object's API group (ie. "deployment.apps").
+func (l *Log) Audit(kind, key string) *event.Audit {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	rec, ok := l.records[kind+"/"+key]
+	if !ok || time.Since(rec.received) > Retention {
+		return nil
+	}
+
+	return &rec.audit
+}
+
+// ServeHTTP receives audit EventList payloads
+func (l *Log) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !l.authorized(r) {
+		l.logger.Errorf("rejected unauthenticated audit events from %s", r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxPayloadSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read payload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var list eventList
+	if err = json.Unmarshal(body, &list); err != nil || list.Kind != "EventList" {
+		l.logger.Errorf("received an invalid audit payload from %s", r.RemoteAddr)
+		http.Error(w, "expecting an audit EventList", http.StatusBadRequest)
+		return
+	}
+
+	l.record(list.Items)
+}
+
+// authorized tells if the request carries our bearer token
+func (l *Log) authorized(r *http.Request) bool {
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if l.token == "" || !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, prefix)), []byte(l.token)) == 1
+}
+
+// record keeps track of the objects changes found in audit events. Kinds are
+// resolved (possibly querying the API server) before the records are locked.
+func (l *Log) record(events []auditEvent) {
+	changes := make(map[string]event.Audit)
+	for _, ev := range events {
+		ref := ev.ObjectRef
+		if ev.Stage != "ResponseComplete" || !verbs[ev.Verb] || ref == nil ||
+			ref.Name == "" || ref.Subresource != "" {
+			continue
+		}
+
+		if ev.ResponseStatus != nil && ev.ResponseStatus.Code/100 != 2 {
+			continue
+		}
+
+		kind, err := l.kindFor(schema.GroupVersionResource{
+			Group:    ref.APIGroup,
+			Version:  ref.APIVersion,
+			Resource: ref.Resource,
+		})
+		if err != nil {
+			l.logger.Errorf("failed to find %s kind: %v", ref.Resource, err)
+			continue
+		}
+
+		user := ev.User.Username
+		if ev.ImpersonatedUser != nil && ev.ImpersonatedUser.Username != "" {
+			user = ev.ImpersonatedUser.Username
+		}
+
+		kind = (&event.Notification{Kind: kind, Group: ref.APIGroup}).QualifiedKind()
+		id := kind + "/" + ref.Name
+		if ref.Namespace != "" {
+			id = kind + "/" + ref.Namespace + "/" + ref.Name
+		}
+
+		if prev, ok := changes[id]; ok && prev.Time.After(ev.StageTimestamp) {
+			continue
+		}
+
+		changes[id] = event.Audit{User: user, Verb: ev.Verb, Time: ev.StageTimestamp}
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for id, audit := range changes {
+		if prev, ok := l.records[id]; ok && prev.audit.Time.After(audit.Time) {
+			continue
+		}
+
+		l.records[id] = record{audit: audit, received: time.Now()}
+	}
+
+	for id, rec := range l.records {
+		if time.Since(rec.received) > Retention {
+			delete(l.records, id)
+		}
+	}
+}
+
+// kindFor returns the (lowercased, as our controllers name them) kind of a
+// resource. The discovery cache is refreshed when we don't know it, at most
+// once per RefreshInterval: meanwhile, unknown resources are remembered.
+func (l *Log) kindFor(gvr schema.GroupVersionResource) (string, error) {
+	l.mapperLock.Lock()
+	defer l.mapperLock.Unlock()
+
+	stale := time.Since(l.refreshed) >= RefreshInterval
+	if err, ok := l.unknown[gvr]; ok && !stale {
+		return "", err
+	}
+
+	gvk, err := l.mapper.KindFor(gvr)
+	if err != nil && stale {
+		l.mapper.Reset()
+		l.refreshed = time.Now()
+		l.unknown = make(map[schema.GroupVersionResource]error)
+		gvk, err = l.mapper.KindFor(gvr)
+	}
+
+	if err != nil {
+		l.unknown[gvr] = err
+	}
+
+	return strings.ToLower(gvk.Kind), err
+}
@@ -0,0 +1,135 @@
+package audit
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type mockLog struct{}
+
+func (m *mockLog) Infof(format string, args ...interface{})  {}
+func (m *mockLog) Errorf(format string, args ...interface{}) {}
+
+type mockMapper struct {
+	*meta.DefaultRESTMapper
+	resets int
+}
+
+func (m *mockMapper) Reset() {
+	m.resets++
+}
+
+func newLog() (*Log, *mockMapper) {
+	mapper := &mockMapper{DefaultRESTMapper: meta.NewDefaultRESTMapper(nil)}
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}, meta.RESTScopeRoot)
+
+	return &Log{
+		logger:  new(mockLog),
+		token:   "s3cr3t",
+		mapper:  mapper,
+		unknown: make(map[schema.GroupVersionResource]error),
+		records: make(map[string]record),
+	}, mapper
+}
+
+func TestAuditWebhook(t *testing.T) {
+	fixture, err := ioutil.ReadFile("testdata/eventlist.json")
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+
+	log, _ := newLog()
+	srv := httptest.NewServer(log)
+	defer srv.Close()
+
+	req, _ := http.NewRequest("POST", srv.URL, strings.NewReader(string(fixture)))
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("failed to post audit events: %v", err)
+	}
+	resp.Body.Close()
+
+	rec := log.Audit("deployment.apps", "default/api")
+	if rec == nil || rec.User != "alice@example.com" || rec.Verb != "patch" {
+		t.Errorf("the latest (non status) change should be recorded, got %+v", rec)
+	}
+
+	if rec = log.Audit("deployment", "default/api"); rec != nil {
+		t.Error("kinds should be qualified by their API group")
+	}
+
+	rec = log.Audit("configmap", "kube-system/foo")
+	if rec == nil || rec.User != "carol@example.com" || rec.Verb != "delete" {
+		t.Errorf("impersonated users should be recorded, got %+v", rec)
+	}
+
+	if rec = log.Audit("namespace", "prod"); rec == nil || rec.User != "erin" {
+		t.Errorf("cluster scoped objects changes should be recorded, got %+v", rec)
+	}
+
+	if rec = log.Audit("configmap", "kube-system/bar"); rec != nil {
+		t.Error("failed requests shouldn't be recorded")
+	}
+
+	if rec = log.Audit("configmap", "default/read"); rec != nil {
+		t.Error("read requests shouldn't be recorded")
+	}
+}
+
+func TestAuditWebhookErrors(t *testing.T) {
+	log, mapper := newLog()
+
+	forged := `{"kind": "EventList", "items": [{"stage": "ResponseComplete", "verb": "patch",
+		"user": {"username": "mallory"}, "objectRef": {"resource": "configmaps", "namespace": "default",
+		"name": "forged", "apiVersion": "v1"}}]}`
+
+	for _, tt := range []struct {
+		method string
+		auth   string
+		body   string
+		code   int
+	}{
+		{"GET", "Bearer s3cr3t", "", http.StatusMethodNotAllowed},
+		{"POST", "", forged, http.StatusUnauthorized},
+		{"POST", "Bearer wrong", forged, http.StatusUnauthorized},
+		{"POST", "s3cr3t", forged, http.StatusUnauthorized},
+		{"POST", "Bearer s3cr3t", "not json", http.StatusBadRequest},
+		{"POST", "Bearer s3cr3t", `{"kind": "Pod"}`, http.StatusBadRequest},
+		{"POST", "Bearer s3cr3t", `{"kind": "EventList", "items": [{"stage": "ResponseComplete", "verb": "delete",
+			"objectRef": {"resource": "unknowns", "name": "foo", "apiVersion": "v1"}}]}`, http.StatusOK},
+	} {
+		req := httptest.NewRequest(tt.method, "/audit", strings.NewReader(tt.body))
+		req.Header.Set("Authorization", tt.auth)
+		rr := httptest.NewRecorder()
+		log.ServeHTTP(rr, req)
+		if rr.Code != tt.code {
+			t.Errorf("%s %q: expected code %d, got %d", tt.method, tt.body, tt.code, rr.Code)
+		}
+	}
+
+	if mapper.resets != 1 {
+		t.Error("unknown resources should trigger a discovery refresh")
+	}
+
+	req := httptest.NewRequest("POST", "/audit", strings.NewReader(`{"kind": "EventList", "items": [
+		{"stage": "ResponseComplete", "verb": "delete", "objectRef": {"resource": "unknowns", "name": "bar", "apiVersion": "v1"}},
+		{"stage": "ResponseComplete", "verb": "delete", "objectRef": {"resource": "others", "name": "baz", "apiVersion": "v1"}}]}`))
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	log.ServeHTTP(httptest.NewRecorder(), req)
+	if mapper.resets != 1 {
+		t.Errorf("discovery refreshes should be rate limited, got %d", mapper.resets)
+	}
+
+	if rec := log.Audit("configmap", "default/forged"); rec != nil {
+		t.Errorf("unauthenticated audit events shouldn't be recorded, got %+v", rec)
+	}
+}
@@ -6,35 +6,38 @@
 package controller
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/bpineau/katafygio/pkg/event"
+	"github.com/bpineau/katafygio/pkg/format"
+	"github.com/bpineau/katafygio/pkg/metrics"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
-
-	"github.com/ghodss/yaml"
 )
 
 var (
 	maxProcessRetry = 6
 	canaryKey       = "$katafygio canary$"
-	unexported      = []string{"selfLink", "uid", "resourceVersion", "generation", "managedFields"}
 )
 
 // Interface describe a standard kubernetes controller
 type Interface interface {
 	Start()
 	Stop()
+	Synced() bool
 }
 
 type logger interface {
@@ -42,6 +45,11 @@ type logger interface {
 	Errorf(format string, args ...interface{})
 }
 
+// Transformer alters objects before they are marshalled and sent to the recorder
+type Transformer interface {
+	Transform(kind string, obj *unstructured.Unstructured) error
+}
+
 // Exclusions groups filters used to ignore objects
 type Exclusions struct {
 	Names      []string
@@ -51,36 +59,56 @@ type Exclusions struct {
 
 // Factory generate controllers
 type Factory struct {
-	logger     logger
-	selector   string
-	resyncIntv time.Duration
-	exclusions *Exclusions
+	logger       logger
+	selector     string
+	resyncIntv   time.Duration
+	exclusions   *Exclusions
+	stripper     *Stripper
+	output       format.Format
+	transformers []Transformer
 }
 
 // Controller is a generic kubernetes controller
 type Controller struct {
-	name       string
-	stopCh     chan struct{}
-	doneCh     chan struct{}
-	syncCh     chan struct{}
-	notifier   event.Notifier
-	queue      workqueue.RateLimitingInterface
-	informer   cache.SharedIndexInformer
-	logger     logger
-	resyncIntv time.Duration
-	exclusions *Exclusions
+	name         string // qualified kind, ie. "deployment.apps"
+	kind         string // lowercased kind, ie. "deployment"
+	cluster      string // in multi-cluster mode
+	stopCh       chan struct{}
+	doneCh       chan struct{}
+	syncCh       chan struct{}
+	synced       int32
+	notifier     event.Notifier
+	queue        workqueue.RateLimitingInterface
+	informer     cache.SharedIndexInformer
+	logger       logger
+	resyncIntv   time.Duration
+	exclusions   *Exclusions
+	stripper     *Stripper
+	output       format.Format
+	transformers []Transformer
+	gvk          schema.GroupVersionKind
 }
 
-// New return a kubernetes controller using the provided client
+// New return a kubernetes controller using the provided client, watching
+// objects of the gvk kind (in the named cluster, in multi-cluster mode). A
+// nil stripper removes the fields listed in DefaultStripRules.
 func New(client cache.ListerWatcher,
 	notifier event.Notifier,
 	log logger,
-	name string,
+	gvk schema.GroupVersionKind,
+	cluster string,
 	selector string,
 	resync time.Duration,
 	exclusions *Exclusions,
+	stripper *Stripper,
+	output format.Format,
+	transformers []Transformer,
 ) *Controller {
 
+	if stripper == nil {
+		stripper, _ = NewStripper(nil)
+	}
+
 	lopts := metav1.ListOptions{LabelSelector: selector, ResourceVersion: "0", AllowWatchBookmarks: true}
 	lw := &cache.ListWatch{
 		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
@@ -98,7 +126,13 @@ func New(client cache.ListerWatcher,
 		cache.Indexers{},
 	)
 
-	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	kind := strings.ToLower(gvk.Kind)
+	name := (&event.Notification{Kind: kind, Group: gvk.Group}).QualifiedKind()
+	queueName := name
+	if cluster != "" {
+		queueName = cluster + "/" + name
+	}
+	queue := workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), queueName)
 
 	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
@@ -122,16 +156,22 @@ func New(client cache.ListerWatcher,
 	})
 
 	return &Controller{
-		stopCh:     make(chan struct{}),
-		doneCh:     make(chan struct{}),
-		syncCh:     make(chan struct{}, 1),
-		notifier:   notifier,
-		name:       name,
-		queue:      queue,
-		informer:   informer,
-		logger:     log,
-		resyncIntv: resync,
-		exclusions: exclusions,
+		stopCh:       make(chan struct{}),
+		doneCh:       make(chan struct{}),
+		syncCh:       make(chan struct{}, 1),
+		notifier:     notifier,
+		name:         name,
+		kind:         kind,
+		cluster:      cluster,
+		queue:        queue,
+		informer:     informer,
+		logger:       log,
+		resyncIntv:   resync,
+		exclusions:   exclusions,
+		stripper:     stripper,
+		output:       output,
+		transformers: transformers,
+		gvk:          gvk,
 	}
 }
 
@@ -161,6 +201,12 @@ func (c *Controller) Stop() {
 	<-c.doneCh
 }
 
+// Synced tells if the controller completed its initial sync (all existing
+// objects were sent to the recorder)
+func (c *Controller) Synced() bool {
+	return atomic.LoadInt32(&c.synced) == 1
+}
+
 func (c *Controller) runWorker() {
 	defer close(c.doneCh)
 	for c.processNextItem() {
@@ -177,6 +223,7 @@ func (c *Controller) processNextItem() bool {
 
 	if strings.Compare(key.(string), canaryKey) == 0 {
 		c.logger.Infof("Initial sync completed for %s controller", c.name)
+		atomic.StoreInt32(&c.synced, 1)
 		c.syncCh <- struct{}{}
 		c.queue.Forget(key)
 		return true
@@ -207,28 +254,24 @@ func (c *Controller) processItem(key string) error {
 	}
 
 	for _, obj := range c.exclusions.Names {
-		if strings.Compare(strings.ToLower(obj), strings.ToLower(c.name+":"+key)) == 0 {
+		// objects kinds may be qualified with their API group (ie. "deployment.apps")
+		obj = strings.ToLower(obj)
+		if obj == strings.ToLower(c.kind+":"+key) || obj == strings.ToLower(c.name+":"+key) {
 			return nil
 		}
 	}
 
 	if !exists {
 		// deleted object
-		c.enqueue(&event.Notification{Action: event.Delete, Key: key, Kind: c.name, Object: nil})
+		c.enqueue(&event.Notification{Action: event.Delete, Key: key, Kind: c.kind,
+			Group: c.gvk.Group, Version: c.gvk.Version, Object: nil})
 		return nil
 	}
 
 	obj := rawobj.(*unstructured.Unstructured).DeepCopy()
+	author := lastManager(obj)
 
-	// clear irrelevant attributes
-	uc := obj.UnstructuredContent()
-	delete(uc, "status")
-	md := uc["metadata"].(map[string]interface{})
-	for _, attr := range unexported {
-		delete(md, attr)
-	}
-
-	if namespace, ok := md["namespace"].(string); ok {
+	if namespace := obj.GetNamespace(); namespace != "" {
 		for _, nsre := range c.exclusions.Namespaces {
 			if nsre.MatchString(namespace) {
 				// Rely on the background sync to delete these excluded files if
@@ -238,34 +281,81 @@ func (c *Controller) processItem(key string) error {
 		}
 	}
 
+	md, _ := obj.Object["metadata"].(map[string]interface{})
 	if _, ok := md["ownerReferences"]; ok && c.exclusions.NoOwnerRef {
 		return nil
 	}
 
-	yml, err := yaml.Marshal(obj)
+	// clear irrelevant attributes
+	c.stripper.Strip(obj)
+
+	for _, tr := range c.transformers {
+		if err := tr.Transform(c.kind, obj); err != nil {
+			return fmt.Errorf("failed to transform %s: %v", key, err)
+		}
+	}
+
+	data, err := c.output.Marshal(obj)
 	if err != nil {
 		return fmt.Errorf("failed to marshal %s: %v", key, err)
 	}
 
-	c.enqueue(&event.Notification{Action: event.Upsert, Key: key, Kind: c.name, Object: yml})
+	c.enqueue(&event.Notification{Action: event.Upsert, Key: key, Kind: c.kind,
+		Group: c.gvk.Group, Version: c.gvk.Version, Object: data, Author: author})
 	return nil
 }
 
+// lastManager returns the name of the field manager (ie. "kubectl-edit") that
+// most recently changed the object, ignoring those only updating its status.
+func lastManager(obj *unstructured.Unstructured) string {
+	var manager string
+	var last time.Time
+	for _, entry := range obj.GetManagedFields() {
+		if entry.FieldsV1 != nil {
+			var fields map[string]interface{}
+			if json.Unmarshal(entry.FieldsV1.Raw, &fields) == nil {
+				if _, ok := fields["f:status"]; ok && len(fields) == 1 {
+					continue
+				}
+			}
+		}
+
+		var when time.Time
+		if entry.Time != nil {
+			when = entry.Time.Time
+		}
+
+		if manager == "" || !when.Before(last) {
+			manager, last = entry.Manager, when
+		}
+	}
+
+	return manager
+}
+
 func (c *Controller) enqueue(notif *event.Notification) {
+	metrics.Events.WithLabelValues(c.cluster, c.name, notif.Action.String()).Inc()
 	c.notifier.Send(notif)
 }
 
-// NewFactory create a controller factory
-func NewFactory(logger logger, selector string, resync int, exclusions *Exclusions) *Factory {
+// NewFactory create a controller factory. Objects fields are stripped
+// following the stripper rules, then transformers are applied, in order,
+// to all objects before they are marshalled in the output format and sent
+// to the recorder.
+func NewFactory(logger logger, selector string, resync int, exclusions *Exclusions,
+	stripper *Stripper, output format.Format, transformers ...Transformer) *Factory {
 	return &Factory{
-		logger:     logger,
-		selector:   selector,
-		resyncIntv: time.Duration(resync) * time.Second,
-		exclusions: exclusions,
+		logger:       logger,
+		selector:     selector,
+		resyncIntv:   time.Duration(resync) * time.Second,
+		exclusions:   exclusions,
+		stripper:     stripper,
+		output:       output,
+		transformers: transformers,
 	}
 }
 
 // NewController create a controller.Controller
-func (f *Factory) NewController(client cache.ListerWatcher, notifier event.Notifier, name string) Interface {
-	return New(client, notifier, f.logger, name, f.selector, f.resyncIntv, f.exclusions)
+func (f *Factory) NewController(client cache.ListerWatcher, notifier event.Notifier, gvk schema.GroupVersionKind, cluster string) Interface {
+	return New(client, notifier, f.logger, gvk, cluster, f.selector, f.resyncIntv, f.exclusions, f.stripper, f.output, f.transformers)
 }
@@ -8,8 +8,11 @@ import (
 	"time"
 
 	"github.com/bpineau/katafygio/pkg/event"
+	"github.com/bpineau/katafygio/pkg/format"
 
+	"github.com/ghodss/yaml"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	fakecontroller "k8s.io/client-go/tools/cache/testing"
 	"k8s.io/klog"
 )
@@ -26,6 +29,13 @@ func (m *mockNotifier) ReadChan() <-chan event.Notification {
 	return make(chan event.Notification)
 }
 
+type mockTransformer struct{}
+
+func (m *mockTransformer) Transform(kind string, obj *unstructured.Unstructured) error {
+	obj.Object["transformed"] = "canary-" + kind
+	return nil
+}
+
 type mockLog struct{}
 
 func (m *mockLog) Infof(format string, args ...interface{})  {}
@@ -162,8 +172,8 @@ func TestController(t *testing.T) {
 		NoOwnerRef: true,
 	}
 
-	f := NewFactory(log, "label1=something", 60, exclusions)
-	ctrl := f.NewController(client, evt, "pod")
+	f := NewFactory(log, "label1=something", 60, exclusions, nil, format.YAML, new(mockTransformer))
+	ctrl := f.NewController(client, evt, schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, "")
 
 	// this will trigger a deletion event
 	idx := ctrl.(*Controller).informer.GetIndexer()
@@ -179,6 +189,10 @@ func TestController(t *testing.T) {
 	client.Add(obj7)
 	client.Modify(obj5)
 
+	if ctrl.Synced() {
+		t.Error("controller shouldn't be synced before starting")
+	}
+
 	ctrl.Start()
 	// wait until queue is drained
 	for ctrl.(*Controller).queue.Len() > 0 {
@@ -186,6 +200,10 @@ func TestController(t *testing.T) {
 	}
 	ctrl.Stop()
 
+	if !ctrl.Synced() {
+		t.Error("controller should report its initial sync")
+	}
+
 	for _, ev := range evt.evts {
 		// ensure deletion notifications pops up as expected
 		if strings.Compare(ev.Key, "ns1/Bar1") == 0 && ev.Action != event.Delete {
@@ -212,9 +230,318 @@ func TestController(t *testing.T) {
 			t.Error("exclude-having-owner-ref filter failed")
 		}
 
+		// ensure transformers are applied
+		if ev.Action == event.Upsert && !strings.Contains(string(ev.Object), "canary-pod") {
+			t.Error("transformers weren't applied")
+		}
+
 		// ensure updates propagate
 		if strings.Contains(string(ev.Object), "canary-bar4") {
 			t.Error("update didn't propagate")
 		}
 	}
 }
+
+func TestLastManager(t *testing.T) {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Foo",
+		"metadata": map[string]interface{}{
+			"name": "Bar",
+			"managedFields": []interface{}{
+				map[string]interface{}{
+					"manager":    "kubectl-client-side-apply",
+					"operation":  "Update",
+					"time":       "2020-01-01T10:00:00Z",
+					"fieldsType": "FieldsV1",
+					"fieldsV1":   map[string]interface{}{"f:spec": map[string]interface{}{}},
+				},
+				map[string]interface{}{
+					"manager":    "kubectl-edit",
+					"operation":  "Update",
+					"time":       "2020-01-02T10:00:00Z",
+					"fieldsType": "FieldsV1",
+					"fieldsV1":   map[string]interface{}{"f:metadata": map[string]interface{}{}},
+				},
+				map[string]interface{}{
+					"manager":    "kube-controller-manager",
+					"operation":  "Update",
+					"time":       "2020-01-03T10:00:00Z",
+					"fieldsType": "FieldsV1",
+					"fieldsV1":   map[string]interface{}{"f:status": map[string]interface{}{}},
+				},
+			},
+		},
+	}}
+
+	if got := lastManager(obj); got != "kubectl-edit" {
+		t.Errorf("lastManager should return the latest non-status manager, got %q", got)
+	}
+
+	if got := lastManager(obj1); got != "" {
+		t.Errorf("lastManager should return nothing on objects without managedFields, got %q", got)
+	}
+}
+
+func TestStripper(t *testing.T) {
+	stripper, err := NewStripper([]StripRule{
+		{
+			Kinds:  []string{"*"},
+			Remove: []string{`metadata.annotations["kubectl.kubernetes.io/last-applied-configuration"]`},
+		},
+		{
+			Kinds:      []string{"apps/*/Deployment"},
+			Remove:     []string{"$.spec.template.spec.containers[*].image", "spec.replicas"},
+			KeepStatus: true,
+		},
+		{
+			Kinds:    []string{"configmap"},
+			KeepOnly: []string{"data.keep", "metadata.labels"},
+		},
+		{
+			Kinds:    []string{"pod"},
+			KeepOnly: []string{"spec.containers[*].env"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create a stripper: %v", err)
+	}
+
+	deploy := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata": map[string]interface{}{
+			"name":            "foo",
+			"uid":             "00000000-0000-0000-0000-000000000042",
+			"resourceVersion": "1",
+			"annotations": map[string]interface{}{
+				"kubectl.kubernetes.io/last-applied-configuration": "{}",
+				"deployment.kubernetes.io/revision":                "2",
+			},
+		},
+		"spec": map[string]interface{}{
+			"replicas": 3,
+			"template": map[string]interface{}{"spec": map[string]interface{}{
+				"containers": []interface{}{
+					map[string]interface{}{"name": "c1", "image": "foo:1"},
+					map[string]interface{}{"name": "c2", "image": "bar:1"},
+				}}},
+		},
+		"status": map[string]interface{}{"replicas": 3},
+	}}
+
+	stripper.Strip(deploy)
+	expected := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  annotations:
+    deployment.kubernetes.io/revision: "2"
+  name: foo
+spec:
+  template:
+    spec:
+      containers:
+      - name: c1
+      - name: c2
+status:
+  replicas: 3
+`
+	if yml, _ := yaml.Marshal(deploy); string(yml) != expected {
+		t.Errorf("deployment wasn't stripped as expected:\n%s", yml)
+	}
+
+	cm := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata": map[string]interface{}{
+			"name":        "foo",
+			"namespace":   "bar",
+			"labels":      map[string]interface{}{"app": "foo"},
+			"annotations": map[string]interface{}{"foo": "bar"},
+		},
+		"data":   map[string]interface{}{"keep": "yes", "drop": "no"},
+		"status": "shouldnotbethere",
+	}}
+
+	stripper.Strip(cm)
+	expected = `apiVersion: v1
+data:
+  keep: "yes"
+kind: ConfigMap
+metadata:
+  labels:
+    app: foo
+  name: foo
+  namespace: bar
+`
+	if yml, _ := yaml.Marshal(cm); string(yml) != expected {
+		t.Errorf("configmap wasn't stripped as expected:\n%s", yml)
+	}
+
+	pod := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   map[string]interface{}{"name": "foo"},
+		"spec": map[string]interface{}{
+			"containers": []interface{}{
+				map[string]interface{}{"name": "c1", "image": "foo:1"},
+				map[string]interface{}{"name": "c2", "env": []interface{}{
+					map[string]interface{}{"name": "FOO", "value": "bar"},
+				}},
+			},
+		},
+	}}
+
+	stripper.Strip(pod)
+	expected = `apiVersion: v1
+kind: Pod
+metadata:
+  name: foo
+spec:
+  containers:
+  - env:
+    - name: FOO
+      value: bar
+`
+	if yml, _ := yaml.Marshal(pod); string(yml) != expected {
+		t.Errorf("pod wasn't stripped as expected:\n%s", yml)
+	}
+
+	if _, err = NewStripper([]StripRule{{Kinds: []string{"*"}, Remove: []string{"spec[foo"}}}); err == nil {
+		t.Error("NewStripper should fail on invalid paths")
+	}
+}
+
+func TestNormalizer(t *testing.T) {
+	norm, err := NewNormalizer([]DefaultValue{
+		{Kinds: []string{"core/*/Service"}, Path: "spec.sessionAffinity"},
+		{Kinds: []string{"apps/*/Deployment"}, Path: "spec.template.spec.containers[*].imagePullPolicy", Value: "IfNotPresent"},
+	})
+	if err != nil {
+		t.Fatalf("failed to create a normalizer: %v", err)
+	}
+
+	svc := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata": map[string]interface{}{
+			"name":              "foo",
+			"creationTimestamp": "2020-01-01T10:00:00Z",
+		},
+		"spec": map[string]interface{}{
+			"clusterIP":       "10.0.0.1",
+			"sessionAffinity": "None",
+			"type":            "NodePort",
+			"ports": []interface{}{
+				map[string]interface{}{"port": int64(80), "protocol": "TCP"},
+				map[string]interface{}{"port": int64(53), "protocol": "UDP"},
+			},
+		},
+	}}
+
+	_ = norm.Transform("service", svc)
+	expected := `apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+spec:
+  ports:
+  - port: 80
+  - port: 53
+    protocol: UDP
+  sessionAffinity: None
+  type: NodePort
+`
+	if yml, _ := yaml.Marshal(svc); string(yml) != expected {
+		t.Errorf("service wasn't normalized as expected:\n%s", yml)
+	}
+
+	headless := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata":   map[string]interface{}{"name": "foo"},
+		"spec":       map[string]interface{}{"clusterIP": "None"},
+	}}
+
+	_ = norm.Transform("service", headless)
+	if ip, _, _ := unstructured.NestedString(headless.Object, "spec", "clusterIP"); ip != "None" {
+		t.Error("normalizer shouldn't remove headless services clusterIP")
+	}
+
+	deploy := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata": map[string]interface{}{
+			"name":        "foo",
+			"annotations": map[string]interface{}{"deployment.kubernetes.io/revision": "3"},
+		},
+		"spec": map[string]interface{}{
+			"progressDeadlineSeconds": int64(600),
+			"revisionHistoryLimit":    int64(5),
+			"strategy": map[string]interface{}{
+				"type":          "RollingUpdate",
+				"rollingUpdate": map[string]interface{}{"maxSurge": "25%", "maxUnavailable": "25%"},
+			},
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{"creationTimestamp": nil},
+				"spec": map[string]interface{}{
+					"dnsPolicy":                     "ClusterFirst",
+					"terminationGracePeriodSeconds": int64(30),
+					"securityContext":               map[string]interface{}{},
+					"containers": []interface{}{
+						map[string]interface{}{
+							"name":                     "c1",
+							"image":                    "foo:1",
+							"imagePullPolicy":          "IfNotPresent",
+							"terminationMessagePath":   "/dev/termination-log",
+							"terminationMessagePolicy": "File",
+							"resources":                map[string]interface{}{},
+						},
+					},
+				},
+			},
+		},
+	}}
+
+	_ = norm.Transform("deployment", deploy)
+	expected = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: foo
+spec:
+  revisionHistoryLimit: 5
+  template:
+    spec:
+      containers:
+      - image: foo:1
+        name: c1
+`
+	if yml, _ := yaml.Marshal(deploy); string(yml) != expected {
+		t.Errorf("deployment wasn't normalized as expected:\n%s", yml)
+	}
+	for _, manual := range []bool{false, true} {
+		job := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "batch/v1",
+			"kind":       "Job",
+			"metadata":   map[string]interface{}{"name": "foo"},
+			"spec": map[string]interface{}{
+				"manualSelector": manual,
+				"selector": map[string]interface{}{
+					"matchLabels": map[string]interface{}{"controller-uid": "1234"},
+				},
+				"template": map[string]interface{}{
+					"metadata": map[string]interface{}{
+						"labels": map[string]interface{}{"controller-uid": "1234", "job-name": "foo"},
+					},
+				},
+			},
+		}}
+
+		_ = norm.Transform("job", job)
+		_, hasSelector, _ := unstructured.NestedMap(job.Object, "spec", "selector")
+		labels, _, _ := unstructured.NestedStringMap(job.Object, "spec", "template", "metadata", "labels")
+		if hasSelector != manual || (len(labels) == 2) != manual {
+			t.Errorf("job with manualSelector=%v: unexpected selector (%v) or labels (%v)", manual, hasSelector, labels)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// DefaultValue describes a server populated or defaulted field, removed by
+// the Normalizer from the objects matching Kinds when it holds Value (or any
+// value, if Any is set). Kinds are globs, as in StripRule.
+type DefaultValue struct {
+	Kinds []string    `mapstructure:"kinds" json:"kinds"`
+	Path  string      `mapstructure:"path" json:"path"`
+	Value interface{} `mapstructure:"value" json:"value"`
+	Any   bool        `mapstructure:"any" json:"any"`
+}
+
+type defaultValue struct {
+	kinds  []string
+	path   string
+	match  func(interface{}) bool
+	unless func(map[string]interface{}) bool
+}
+
+type defaultRule struct {
+	stripRule
+	path   fieldPath
+	match  func(interface{}) bool
+	unless func(map[string]interface{}) bool
+}
+
+// Normalizer removes the fields the API server populates or defaults, so
+// saved objects look like what a human would author (and are easy to apply).
+type Normalizer struct {
+	defaults []defaultRule
+}
+
+var (
+	// pod specs locations, by kind
+	podSpecs = map[string][]string{
+		"spec":                                {"core/*/Pod"},
+		"spec.template.spec":                  {"apps/*/Deployment", "apps/*/StatefulSet", "apps/*/DaemonSet", "apps/*/ReplicaSet", "core/*/ReplicationController", "batch/*/Job"},
+		"spec.jobTemplate.spec.template.spec": {"batch/*/CronJob"},
+	}
+
+	podSpecDefaults = map[string]interface{}{
+		"restartPolicy":                 "Always",
+		"dnsPolicy":                     "ClusterFirst",
+		"schedulerName":                 "default-scheduler",
+		"securityContext":               map[string]interface{}{},
+		"terminationGracePeriodSeconds": 30,
+	}
+
+	containerDefaults = map[string]interface{}{
+		"terminationMessagePath":   "/dev/termination-log",
+		"terminationMessagePolicy": "File",
+		"resources":                map[string]interface{}{},
+		"ports[*].protocol":        "TCP",
+	}
+
+	emptyMap = map[string]interface{}{}
+)
+
+// builtinDefaults lists the fields known to be populated or defaulted by the API server
+func builtinDefaults() []defaultValue {
+	var defaults []defaultValue
+	add := func(kinds []string, path string, match func(interface{}) bool) {
+		defaults = append(defaults, defaultValue{kinds: kinds, path: path, match: match})
+	}
+
+	all := []string{"*"}
+	add(all, "metadata.creationTimestamp", anything)
+
+	for prefix, kinds := range podSpecs {
+		for field, value := range podSpecDefaults {
+			add(kinds, prefix+"."+field, equals(value))
+		}
+		add(kinds, prefix+".serviceAccount", anything)
+		for _, containers := range []string{"containers", "initContainers"} {
+			for field, value := range containerDefaults {
+				add(kinds, prefix+"."+containers+"[*]."+field, equals(value))
+			}
+		}
+		if tmpl := strings.TrimSuffix(prefix, ".spec"); tmpl != prefix {
+			add(kinds, tmpl+".metadata.creationTimestamp", equals(nil))
+		}
+	}
+
+	pod := []string{"core/*/Pod"}
+	add(pod, "spec.nodeName", anything)
+	add(pod, "spec.enableServiceLinks", equals(true))
+	add(pod, "spec.priority", equals(0))
+
+	deploy := []string{"apps/*/Deployment"}
+	add(deploy, `metadata.annotations["deployment.kubernetes.io/revision"]`, anything)
+	add(deploy, "spec.progressDeadlineSeconds", equals(600))
+	add(deploy, "spec.revisionHistoryLimit", equals(10))
+	add(deploy, "spec.strategy", equals(map[string]interface{}{
+		"type":          "RollingUpdate",
+		"rollingUpdate": map[string]interface{}{"maxSurge": "25%", "maxUnavailable": "25%"},
+	}))
+
+	sts := []string{"apps/*/StatefulSet"}
+	add(sts, "spec.podManagementPolicy", equals("OrderedReady"))
+	add(sts, "spec.revisionHistoryLimit", equals(10))
+	add(sts, "spec.updateStrategy", equals(map[string]interface{}{
+		"type":          "RollingUpdate",
+		"rollingUpdate": map[string]interface{}{"partition": 0},
+	}))
+
+	ds := []string{"apps/*/DaemonSet"}
+	add(ds, "spec.revisionHistoryLimit", equals(10))
+	add(ds, "spec.updateStrategy", equals(map[string]interface{}{
+		"type":          "RollingUpdate",
+		"rollingUpdate": map[string]interface{}{"maxUnavailable": 1},
+	}))
+	add(ds, "spec.updateStrategy", equals(map[string]interface{}{
+		"type":          "RollingUpdate",
+		"rollingUpdate": map[string]interface{}{"maxUnavailable": 1, "maxSurge": 0},
+	}))
+
+	// jobs selectors and labels are generated from the job uid: they must go,
+	// unless the user provided them (with a manual selector)
+	job := []string{"batch/*/Job"}
+	generated := len(defaults)
+	add(job, "spec.selector", anything)
+	for _, label := range []string{"controller-uid", "job-name", "batch.kubernetes.io/controller-uid", "batch.kubernetes.io/job-name"} {
+		add(job, fmt.Sprintf("spec.template.metadata.labels[%q]", label), anything)
+	}
+	for i := generated; i < len(defaults); i++ {
+		defaults[i].unless = manualSelector
+	}
+	add(job, "spec.template.metadata.labels", equals(emptyMap))
+	add(job, "spec.backoffLimit", equals(6))
+	add(job, "spec.completions", equals(1))
+	add(job, "spec.parallelism", equals(1))
+
+	cron := []string{"batch/*/CronJob"}
+	add(cron, "spec.concurrencyPolicy", equals("Allow"))
+	add(cron, "spec.failedJobsHistoryLimit", equals(1))
+	add(cron, "spec.successfulJobsHistoryLimit", equals(3))
+	add(cron, "spec.suspend", equals(false))
+	add(cron, "spec.jobTemplate.metadata.creationTimestamp", equals(nil))
+
+	// headless services' "None" clusterIP is set by users
+	svc := []string{"core/*/Service"}
+	add(svc, "spec.clusterIP", not(equals("None")))
+	add(svc, "spec.clusterIPs", not(equals([]interface{}{"None"})))
+	add(svc, "spec.sessionAffinity", equals("None"))
+	add(svc, "spec.type", equals("ClusterIP"))
+	add(svc, "spec.ports[*].protocol", equals("TCP"))
+	add(svc, "spec.ipFamilies", equals([]interface{}{"IPv4"}))
+	add(svc, "spec.ipFamilyPolicy", equals("SingleStack"))
+	add(svc, "spec.internalTrafficPolicy", equals("Cluster"))
+
+	pvc := []string{"core/*/PersistentVolumeClaim"}
+	for _, annotation := range []string{"pv.kubernetes.io/bind-completed", "pv.kubernetes.io/bound-by-controller",
+		"volume.beta.kubernetes.io/storage-provisioner", "volume.kubernetes.io/storage-provisioner"} {
+		add(pvc, fmt.Sprintf("metadata.annotations[%q]", annotation), anything)
+	}
+	add(pvc, "spec.volumeMode", equals("Filesystem"))
+
+	ns := []string{"core/*/Namespace"}
+	add(ns, `metadata.labels["kubernetes.io/metadata.name"]`, anything)
+	add(ns, "spec.finalizers", equals([]interface{}{"kubernetes"}))
+	add(ns, "spec", equals(emptyMap))
+
+	// cleanup what may have been emptied by the previous rules
+	add(all, "metadata.annotations", equals(emptyMap))
+	add(all, "metadata.labels", equals(emptyMap))
+	add(all, "spec.template.metadata", equals(emptyMap))
+
+	return defaults
+}
+
+// NewNormalizer returns a Normalizer using the builtin defaults table. Overrides
+// replace the builtin entries having the same kinds and path (an override
+// without any value nor Any flag disables the entry), or are added to them.
+func NewNormalizer(overrides []DefaultValue) (*Normalizer, error) {
+	defaults := builtinDefaults()
+
+	for _, ov := range overrides {
+		def := defaultValue{kinds: ov.Kinds, path: ov.Path, match: equals(ov.Value)}
+		if ov.Any {
+			def.match = anything
+		} else if ov.Value == nil {
+			def.match = nil
+		}
+
+		replaced := false
+		for i, d := range defaults {
+			if d.path == def.path && strings.Join(d.kinds, ",") == strings.Join(def.kinds, ",") {
+				defaults[i].match, replaced = def.match, true
+			}
+		}
+
+		if !replaced {
+			defaults = append(defaults, def)
+		}
+	}
+
+	n := &Normalizer{}
+	for _, d := range defaults {
+		if d.match == nil {
+			continue // disabled by an override
+		}
+
+		fp, err := parsePath(d.path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid apply-ready default: %v", err)
+		}
+
+		rule := defaultRule{path: fp, match: d.match, unless: d.unless}
+		for _, kind := range d.kinds {
+			rule.kinds = append(rule.kinds, strings.ToLower(kind))
+		}
+
+		n.defaults = append(n.defaults, rule)
+	}
+
+	return n, nil
+}
+
+// Transform removes the server defaulted fields from an object
+func (n *Normalizer) Transform(kind string, obj *unstructured.Unstructured) error {
+	gvk := obj.GroupVersionKind()
+	group := gvk.Group
+	if group == "" {
+		group = "core"
+	}
+	gvkName := strings.ToLower(group + "/" + gvk.Version + "/" + gvk.Kind)
+
+	for _, d := range n.defaults {
+		if d.matches(strings.ToLower(gvk.Kind), gvkName) && (d.unless == nil || !d.unless(obj.Object)) {
+			removePath(obj.Object, d.path, d.match)
+		}
+	}
+
+	return nil
+}
+
+func manualSelector(obj map[string]interface{}) bool {
+	manual, _, _ := unstructured.NestedBool(obj, "spec", "manualSelector")
+	return manual
+}
+
+func anything(interface{}) bool {
+	return true
+}
+
+func not(match func(interface{}) bool) func(interface{}) bool {
+	return func(v interface{}) bool { return !match(v) }
+}
+
+// equals compares values by their JSON representation, so numbers types
+// (ie. int vs. int64) and maps parsed from config files don't matter.
+func equals(expected interface{}) func(interface{}) bool {
+	want, err := json.Marshal(jsonable(expected))
+	return func(v interface{}) bool {
+		got, gerr := json.Marshal(v)
+		return err == nil && gerr == nil && string(got) == string(want)
+	}
+}
+
+// jsonable converts the map[interface{}]interface{} yaml parsers may produce
+func jsonable(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, e := range val {
+			m[fmt.Sprint(k)] = jsonable(e)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, e := range val {
+			m[k] = jsonable(e)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(val))
+		for i, e := range val {
+			l[i] = jsonable(e)
+		}
+		return l
+	}
+	return v
+}
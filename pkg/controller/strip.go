@@ -0,0 +1,261 @@
+package controller
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// StripRule describes fields to remove from the objects matching Kinds.
+//
+// Kinds are globs matched against either the objects kind (ie. "Deployment"),
+// or their "group/version/kind" (ie. "apps/*/Deployment", with "core" as the
+// core API group name). Paths are dot separated fields names, where names
+// containing dots can be quoted with brackets (ie.
+// `metadata.annotations["deployment.kubernetes.io/revision"]`), and where "*"
+// (or "[*]", for lists) matches any field or list element.
+type StripRule struct {
+	Kinds      []string `mapstructure:"kinds" json:"kinds"`
+	Remove     []string `mapstructure:"remove" json:"remove"`
+	KeepOnly   []string `mapstructure:"keep-only" json:"keep-only"`
+	KeepStatus bool     `mapstructure:"keep-status" json:"keep-status"`
+}
+
+// DefaultStripRules removes the volatile metadata, that would cause useless
+// changes. Objects status are also removed, unless a rule says otherwise.
+var DefaultStripRules = []StripRule{
+	{
+		Kinds: []string{"*"},
+		Remove: []string{
+			"metadata.selfLink",
+			"metadata.uid",
+			"metadata.resourceVersion",
+			"metadata.generation",
+			"metadata.managedFields",
+		},
+	},
+}
+
+// the fields we keep regardless of keep-only rules
+var identityPaths = []string{"apiVersion", "kind", "metadata.name", "metadata.namespace"}
+
+type fieldPath []string
+
+type stripRule struct {
+	kinds      []string
+	remove     []fieldPath
+	keepOnly   []fieldPath
+	keepStatus bool
+}
+
+// Stripper removes irrelevant fields from objects, following a set of rules
+type Stripper struct {
+	rules []stripRule
+}
+
+// NewStripper compiles strip rules. The default rules are always applied first.
+func NewStripper(rules []StripRule) (*Stripper, error) {
+	s := &Stripper{}
+	for i, rule := range append(DefaultStripRules, rules...) {
+		r := stripRule{keepStatus: rule.KeepStatus}
+
+		for _, kind := range rule.Kinds {
+			if _, err := path.Match(kind, ""); err != nil {
+				return nil, fmt.Errorf("invalid kind glob %q in strip rule %d: %v", kind, i, err)
+			}
+			r.kinds = append(r.kinds, strings.ToLower(kind))
+		}
+
+		for _, p := range rule.Remove {
+			fp, err := parsePath(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path in strip rule %d: %v", i, err)
+			}
+			r.remove = append(r.remove, fp)
+		}
+
+		if len(rule.KeepOnly) > 0 {
+			for _, p := range append(identityPaths, rule.KeepOnly...) {
+				fp, err := parsePath(p)
+				if err != nil {
+					return nil, fmt.Errorf("invalid path in strip rule %d: %v", i, err)
+				}
+				r.keepOnly = append(r.keepOnly, fp)
+			}
+		}
+
+		s.rules = append(s.rules, r)
+	}
+
+	return s, nil
+}
+
+// Strip removes the fields the rules matching the object wants removed
+func (s *Stripper) Strip(obj *unstructured.Unstructured) {
+	gvk := obj.GroupVersionKind()
+	group := gvk.Group
+	if group == "" {
+		group = "core"
+	}
+	kind := strings.ToLower(gvk.Kind)
+	gvkName := strings.ToLower(group + "/" + gvk.Version + "/" + gvk.Kind)
+
+	keepStatus := false
+	for _, rule := range s.rules {
+		if !rule.matches(kind, gvkName) {
+			continue
+		}
+
+		keepStatus = keepStatus || rule.keepStatus
+
+		for _, fp := range rule.remove {
+			removePath(obj.Object, fp, nil)
+		}
+
+		if len(rule.keepOnly) > 0 {
+			keepPaths(obj.Object, rule.keepOnly)
+		}
+	}
+
+	if !keepStatus {
+		delete(obj.Object, "status")
+	}
+}
+
+func (r *stripRule) matches(kind, gvkName string) bool {
+	for _, glob := range r.kinds {
+		name := kind
+		if strings.Contains(glob, "/") {
+			name = gvkName
+		}
+
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parsePath splits a path like `.spec.containers[*]["foo.bar"]` in fields
+func parsePath(p string) (fieldPath, error) {
+	var fp fieldPath
+	s := strings.TrimPrefix(strings.TrimPrefix(p, "$"), ".")
+
+	for len(s) > 0 {
+		switch {
+		case s[0] == '.':
+			s = s[1:]
+		case s[0] == '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated bracket in %q", p)
+			}
+			field := s[1:end]
+			if unquoted, err := strconv.Unquote(field); err == nil {
+				field = unquoted
+			} else if len(field) > 1 && field[0] == '\'' && field[len(field)-1] == '\'' {
+				field = field[1 : len(field)-1]
+			}
+			fp = append(fp, field)
+			s = s[end+1:]
+		default:
+			end := strings.IndexAny(s, ".[")
+			if end < 0 {
+				end = len(s)
+			}
+			fp = append(fp, s[:end])
+			s = s[end:]
+		}
+	}
+
+	if len(fp) == 0 {
+		return nil, fmt.Errorf("empty path %q", p)
+	}
+
+	return fp, nil
+}
+
+// fieldMatches tells if a path field matches a map key or a list index
+func fieldMatches(field, key string) bool {
+	return field == "*" || field == key
+}
+
+// removePath deletes the fields matching a path, when their values
+// satisfy the (optional) match function.
+func removePath(node interface{}, fp fieldPath, match func(interface{}) bool) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for key, child := range n {
+			if !fieldMatches(fp[0], key) {
+				continue
+			}
+			if len(fp) > 1 {
+				removePath(child, fp[1:], match)
+			} else if match == nil || match(child) {
+				delete(n, key)
+			}
+		}
+	case []interface{}:
+		// removing list elements would shift the others: we only descend
+		if len(fp) == 1 {
+			return
+		}
+		for i, child := range n {
+			if fieldMatches(fp[0], strconv.Itoa(i)) {
+				removePath(child, fp[1:], match)
+			}
+		}
+	}
+}
+
+// keepPaths removes everything but the provided paths (and their children),
+// and returns the pruned node. Lists elements left empty by the pruning are
+// dropped, rather than kept as "{}" placeholders.
+func keepPaths(node interface{}, paths []fieldPath) interface{} {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for key, child := range n {
+			if next, keepAll := descend(paths, key); !keepAll {
+				if len(next) == 0 {
+					delete(n, key)
+				} else {
+					n[key] = keepPaths(child, next)
+				}
+			}
+		}
+	case []interface{}:
+		kept := make([]interface{}, 0, len(n))
+		for i, child := range n {
+			if next, keepAll := descend(paths, strconv.Itoa(i)); !keepAll {
+				child = keepPaths(child, next)
+				if m, ok := child.(map[string]interface{}); ok && len(m) == 0 {
+					continue
+				}
+			}
+			kept = append(kept, child)
+		}
+		return kept
+	}
+
+	return node
+}
+
+// descend returns the remainders of the paths matching a key, and
+// whether a path fully matched (so the whole subtree is kept).
+func descend(paths []fieldPath, key string) (next []fieldPath, keepAll bool) {
+	for _, fp := range paths {
+		if !fieldMatches(fp[0], key) {
+			continue
+		}
+		if len(fp) == 1 {
+			return nil, true
+		}
+		next = append(next, fp[1:])
+	}
+
+	return next, false
+}
@@ -0,0 +1,381 @@
+// Package crypt encrypts sensitive objects values (ie. secrets' data) before
+// they are written to disk, and decrypts them back for restores.
+//
+// Values are encrypted with a random AES-256 data key, wrapped (RSA-OAEP) with
+// the user provided public key and stored alongside encrypted objects, in
+// an annotation. The data key and its wrapped form are kept in a data key
+// file (created when missing), so they survive restarts and may be shared
+// by several replicas. Only the values of the "data" and "stringData" fields
+// are encrypted (so files remain diffable), using a SOPS-like notation:
+// ENC[AES256_GCM,data:<base64>,iv:<base64>,tag:<base64>,type:str].
+//
+// Nonces are derived from the values, the data key and the object identity,
+// so unchanged objects yield identical files (and no spurious commits), while
+// equal values in distinct objects (or fields) don't yield equal ciphertexts.
+// The object identity and field are also authenticated (as GCM additional
+// data), so values can't be moved between objects.
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// Annotation holds the wrapped data key on encrypted objects
+	Annotation = "katafygio/encrypted-data-key"
+
+	dataKeySize = 32
+	nonceSize   = 12
+	tagSize     = 16
+)
+
+var (
+	encryptedFields = []string{"data", "stringData"}
+	encryptedRe     = regexp.MustCompile(`^ENC\[AES256_GCM,data:([^,]*),iv:([^,]+),tag:([^,]+),type:str\]$`)
+)
+
+// Encrypter encrypts selected objects kinds with a public key
+type Encrypter struct {
+	kinds      []string
+	dataKey    []byte
+	wrappedKey string
+	aead       cipher.AEAD
+}
+
+// Decrypter decrypts objects with a private key
+type Decrypter struct {
+	key *rsa.PrivateKey
+}
+
+// NewEncrypter returns an Encrypter for the given kinds (ie. "secret"),
+// using the PEM encoded RSA public key stored at keyPath. The data key is
+// read from dataKeyPath, or generated and saved there when missing (keep it
+// out of the dumped directory, as it's not encrypted). Without dataKeyPath,
+// a new data key is drawn, and all objects are encrypted anew on each start.
+func NewEncrypter(keyPath, dataKeyPath string, kinds []string) (*Encrypter, error) {
+	block, err := readPEM(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := parsePublicKey(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key %s: %v", keyPath, err)
+	}
+
+	var dataKey []byte
+	var wrapped string
+	if dataKeyPath != "" {
+		dataKey, wrapped, err = loadDataKey(dataKeyPath, pub)
+	}
+	if dataKey == nil && (err == nil || os.IsNotExist(err)) {
+		dataKey, wrapped, err = newDataKey(dataKeyPath, pub)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Encrypter{
+		kinds:      kinds,
+		dataKey:    dataKey,
+		wrappedKey: wrapped,
+		aead:       aead,
+	}, nil
+}
+
+// loadDataKey reads a data key file, holding the base64 encoded data key, the
+// wrapped data key, and the wrapping public key's fingerprint, one per line
+func loadDataKey(path string, pub *rsa.PublicKey) ([]byte, string, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, "", err
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read data key %s: %v", path, err)
+	}
+
+	lines := strings.Fields(string(data))
+	if len(lines) != 3 {
+		return nil, "", fmt.Errorf("malformed data key file %s", path)
+	}
+
+	if lines[2] != fingerprint(pub) {
+		return nil, "", fmt.Errorf("data key file %s was created for an other public key", path)
+	}
+
+	dataKey, err := base64.StdEncoding.DecodeString(lines[0])
+	if err != nil || len(dataKey) != dataKeySize {
+		return nil, "", fmt.Errorf("malformed data key in %s", path)
+	}
+
+	return dataKey, lines[1], nil
+}
+
+// newDataKey draws a data key, and saves it to path (if any)
+func newDataKey(path string, pub *rsa.PublicKey) ([]byte, string, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, "", fmt.Errorf("failed to generate a data key: %v", err)
+	}
+
+	raw, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, dataKey, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to wrap the data key: %v", err)
+	}
+	wrapped := base64.StdEncoding.EncodeToString(raw)
+
+	if path == "" {
+		return dataKey, wrapped, nil
+	}
+
+	content := fmt.Sprintf("%s\n%s\n%s\n", base64.StdEncoding.EncodeToString(dataKey), wrapped, fingerprint(pub))
+	if err = ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		return nil, "", fmt.Errorf("failed to save the data key: %v", err)
+	}
+
+	return dataKey, wrapped, nil
+}
+
+// fingerprint identifies a public key
+func fingerprint(pub *rsa.PublicKey) string {
+	sum := sha256.Sum256(x509.MarshalPKCS1PublicKey(pub))
+	return "sha256:" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Transform encrypts an object's sensitive values, if the object is of a selected kind
+func (e *Encrypter) Transform(kind string, obj *unstructured.Unstructured) error {
+	if !e.selected(kind) {
+		return nil
+	}
+
+	id := identity(obj)
+	for _, field := range encryptedFields {
+		values, ok := obj.Object[field].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		for k, v := range values {
+			str, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("can't encrypt non string value %s.%s", field, k)
+			}
+			values[k] = e.encrypt(id+"\x00"+field+"/"+k, str)
+		}
+	}
+
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[Annotation] = e.wrappedKey
+	obj.SetAnnotations(annotations)
+
+	return nil
+}
+
+func (e *Encrypter) selected(kind string) bool {
+	for _, k := range e.kinds {
+		if strings.Compare(strings.ToLower(k), strings.ToLower(kind)) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// identity names an object, so its values are bound to it
+func identity(obj *unstructured.Unstructured) string {
+	return strings.ToLower(obj.GetKind()) + "/" + obj.GetNamespace() + "/" + obj.GetName()
+}
+
+func (e *Encrypter) encrypt(path, value string) string {
+	mac := hmac.New(sha256.New, e.dataKey)
+	_, _ = mac.Write([]byte(path + "\x00" + value))
+	nonce := mac.Sum(nil)[:nonceSize]
+
+	sealed := e.aead.Seal(nil, nonce, []byte(value), []byte(path))
+	ct, tag := sealed[:len(sealed)-tagSize], sealed[len(sealed)-tagSize:]
+
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:str]",
+		base64.StdEncoding.EncodeToString(ct),
+		base64.StdEncoding.EncodeToString(nonce),
+		base64.StdEncoding.EncodeToString(tag))
+}
+
+// NewDecrypter returns a Decrypter using the PEM encoded RSA private key stored at keyPath
+func NewDecrypter(keyPath string) (*Decrypter, error) {
+	block, err := readPEM(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parsePrivateKey(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %v", keyPath, err)
+	}
+
+	return &Decrypter{key: key}, nil
+}
+
+// Decrypt restores an encrypted object's values. Non encrypted objects are left untouched.
+func (d *Decrypter) Decrypt(obj *unstructured.Unstructured) error {
+	annotations := obj.GetAnnotations()
+	wrapped, ok := annotations[Annotation]
+	if !ok {
+		return nil
+	}
+
+	if d == nil {
+		return fmt.Errorf("object is encrypted, but no decryption key was provided")
+	}
+
+	rawKey, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return fmt.Errorf("failed to decode the data key: %v", err)
+	}
+
+	dataKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, d.key, rawKey, nil)
+	if err != nil {
+		return fmt.Errorf("failed to unwrap the data key: %v", err)
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+
+	id := identity(obj)
+	for _, field := range encryptedFields {
+		values, ok := obj.Object[field].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		for k, v := range values {
+			str, _ := v.(string)
+			plain, err := decrypt(aead, id+"\x00"+field+"/"+k, str)
+			if err != nil {
+				// encrypted by an earlier version, not binding the object identity
+				plain, err = decrypt(aead, field+"/"+k, str)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to decrypt %s.%s: %v", field, k, err)
+			}
+			values[k] = plain
+		}
+	}
+
+	delete(annotations, Annotation)
+	if len(annotations) == 0 {
+		annotations = nil
+	}
+	obj.SetAnnotations(annotations)
+
+	return nil
+}
+
+func decrypt(aead cipher.AEAD, path, value string) (string, error) {
+	m := encryptedRe.FindStringSubmatch(value)
+	if m == nil {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+
+	var parts [3][]byte
+	for i := range parts {
+		var err error
+		parts[i], err = base64.StdEncoding.DecodeString(m[i+1])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if len(parts[1]) != nonceSize {
+		return "", fmt.Errorf("invalid nonce size")
+	}
+
+	plain, err := aead.Open(nil, parts[1], append(parts[0], parts[2]...), []byte(path))
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a cipher: %v", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func readPEM(path string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key %s: %v", path, err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	return block, nil
+}
+
+func parsePublicKey(block *pem.Block) (*rsa.PublicKey, error) {
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA public key")
+	}
+
+	return pub, nil
+}
+
+func parsePrivateKey(block *pem.Block) (*rsa.PrivateKey, error) {
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	priv, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA private key")
+	}
+
+	return priv, nil
+}
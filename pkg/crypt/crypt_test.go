@@ -0,0 +1,169 @@
+package crypt
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func newSecret() *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata": map[string]interface{}{
+				"name":      "foo",
+				"namespace": "bar",
+			},
+			"data": map[string]interface{}{
+				"password": "c2VjcmV0",
+				"empty":    "",
+			},
+			"stringData": map[string]interface{}{
+				"token": "canary-token",
+			},
+		},
+	}
+}
+
+func writeKeys(t *testing.T, dir string) (string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate a key: %v", err)
+	}
+
+	pubDer, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal a public key: %v", err)
+	}
+
+	pub := dir + "/key.pub"
+	priv := dir + "/key"
+	_ = ioutil.WriteFile(pub, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDer}), 0600)
+	_ = ioutil.WriteFile(priv, pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+
+	return pub, priv
+}
+
+func TestCrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "katafygio-tests")
+	if err != nil {
+		t.Fatal("failed to create a temp dir for tests")
+	}
+	defer os.RemoveAll(dir)
+
+	pub, priv := writeKeys(t, dir)
+
+	enc, err := NewEncrypter(pub, dir+"/data.key", []string{"secret"})
+	if err != nil {
+		t.Fatalf("failed to create an encrypter: %v", err)
+	}
+
+	obj := newSecret()
+	if err = enc.Transform("secret", obj); err != nil {
+		t.Errorf("failed to encrypt: %v", err)
+	}
+
+	yml, _ := obj.MarshalJSON()
+	if strings.Contains(string(yml), "canary-token") || strings.Contains(string(yml), "c2VjcmV0") {
+		t.Errorf("secret values weren't encrypted: %s", yml)
+	}
+
+	if _, ok := obj.GetAnnotations()[Annotation]; !ok {
+		t.Error("encrypted objects should carry the wrapped data key")
+	}
+
+	again := newSecret()
+	_ = enc.Transform("secret", again)
+	if !reflect.DeepEqual(obj, again) {
+		t.Error("unchanged objects should be encrypted the same way")
+	}
+
+	// the data key is reused across restarts
+	restarted, err := NewEncrypter(pub, dir+"/data.key", []string{"secret"})
+	if err != nil {
+		t.Fatalf("failed to create an encrypter from a saved data key: %v", err)
+	}
+	again = newSecret()
+	_ = restarted.Transform("secret", again)
+	if !reflect.DeepEqual(obj, again) {
+		t.Error("unchanged objects should be encrypted the same way after a restart")
+	}
+
+	// equal values in other objects don't yield equal ciphertexts
+	twin := newSecret()
+	twin.SetName("twin")
+	_ = enc.Transform("secret", twin)
+	if twin.Object["data"].(map[string]interface{})["password"] == obj.Object["data"].(map[string]interface{})["password"] {
+		t.Error("equal values in distinct objects should be encrypted differently")
+	}
+
+	other := newSecret()
+	_ = enc.Transform("configmap", other)
+	if !reflect.DeepEqual(other, newSecret()) {
+		t.Error("non selected kinds shouldn't be encrypted")
+	}
+
+	var nodec *Decrypter
+	if err = nodec.Decrypt(obj.DeepCopy()); err == nil {
+		t.Error("decrypting without a key should fail")
+	}
+
+	dec, err := NewDecrypter(priv)
+	if err != nil {
+		t.Fatalf("failed to create a decrypter: %v", err)
+	}
+
+	if err = dec.Decrypt(obj); err != nil {
+		t.Errorf("failed to decrypt: %v", err)
+	}
+
+	if !reflect.DeepEqual(obj, newSecret()) {
+		t.Errorf("decrypted object differs from the original: %v", obj)
+	}
+
+	_ = enc.Transform("secret", obj)
+	obj.Object["data"].(map[string]interface{})["password"] = obj.Object["data"].(map[string]interface{})["empty"]
+	if err = dec.Decrypt(obj); err == nil {
+		t.Error("decrypting a value moved to an other field should fail")
+	}
+
+	moved := newSecret()
+	_ = enc.Transform("secret", moved)
+	moved.Object["data"].(map[string]interface{})["password"] = twin.Object["data"].(map[string]interface{})["password"]
+	if err = dec.Decrypt(moved); err == nil {
+		t.Error("decrypting a value moved from an other object should fail")
+	}
+
+	// values encrypted without the object identity (by earlier versions)
+	legacy := newSecret()
+	legacy.SetAnnotations(map[string]string{Annotation: enc.wrappedKey})
+	legacy.Object["stringData"].(map[string]interface{})["token"] = enc.encrypt("stringData/token", "canary-token")
+	legacy.Object["data"] = nil
+	if err = dec.Decrypt(legacy); err != nil || legacy.Object["stringData"].(map[string]interface{})["token"] != "canary-token" {
+		t.Errorf("values encrypted by earlier versions should be decrypted (%v)", err)
+	}
+
+	if _, err = NewEncrypter(priv, "", nil); err == nil {
+		t.Error("NewEncrypter should fail with a non public key")
+	}
+
+	_ = os.Mkdir(dir+"/other", 0700)
+	otherPub, _ := writeKeys(t, dir+"/other")
+	if _, err = NewEncrypter(otherPub, dir+"/data.key", nil); err == nil {
+		t.Error("NewEncrypter should refuse a data key wrapped by an other public key")
+	}
+
+	if _, err = NewDecrypter(dir + "/nonexistent"); err == nil {
+		t.Error("NewDecrypter should fail with a missing key")
+	}
+}
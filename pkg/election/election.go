@@ -0,0 +1,202 @@
+// Package election elects a leader among katafygio replicas, using a
+// Kubernetes Lease, so only one of them dumps, commits and pushes objects at
+// a given time. Standby replicas keep trying to acquire the lease, and take
+// over once the leader released it, or failed to renew it.
+package election
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	"github.com/bpineau/katafygio/pkg/metrics"
+)
+
+const (
+	// LeaseDuration is how long standbys wait before taking over a lease
+	// that wasn't renewed
+	LeaseDuration = 15 * time.Second
+
+	// RenewDeadline is how long the leader retries renewing the lease,
+	// before giving up the leadership
+	RenewDeadline = 10 * time.Second
+
+	// RetryPeriod is the interval between lease acquisition or renewal attempts
+	RetryPeriod = 2 * time.Second
+)
+
+type logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Elector campaigns for a Lease, and tells when we lead, or lost the lead
+type Elector struct {
+	logger    logger
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	identity  string
+
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+
+	lock      sync.Mutex // protect leading
+	leading   bool
+	lease     *lease
+	leadingCh chan struct{}
+	lostCh    chan struct{}
+	doneCh    chan struct{}
+	cancel    context.CancelFunc
+}
+
+var errStopping = errors.New("elector is stopping")
+
+// lease holds back client-go's elector lease attempts once we're stopping.
+// The elector doesn't wait for an attempt outliving its cancelled context
+// (the attempt would then race with the lease release): Stop waits until
+// a new attempt is held back, so no other one is in flight.
+type lease struct {
+	resourcelock.Interface
+	ctx      context.Context
+	stopping chan struct{}
+	held     chan struct{}
+	holdOnce sync.Once
+}
+
+func (l *lease) Get() (*resourcelock.LeaderElectionRecord, []byte, error) {
+	select {
+	case <-l.stopping:
+		l.holdOnce.Do(func() { close(l.held) })
+		<-l.ctx.Done()
+		return nil, nil, errStopping
+	default:
+		return l.Interface.Get()
+	}
+}
+
+// New creates an Elector for the namespace/name Lease. identity must be
+// unique among the replicas (ie. the pod name).
+func New(log logger, client kubernetes.Interface, namespace, name, identity string) *Elector {
+	return &Elector{
+		logger:        log,
+		client:        client,
+		namespace:     namespace,
+		name:          name,
+		identity:      identity,
+		LeaseDuration: LeaseDuration,
+		RenewDeadline: RenewDeadline,
+		RetryPeriod:   RetryPeriod,
+		leadingCh:     make(chan struct{}),
+		lostCh:        make(chan struct{}),
+		doneCh:        make(chan struct{}),
+	}
+}
+
+// Start campaigns for the lease, in the background
+func (e *Elector) Start() (*Elector, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	e.lease = &lease{
+		Interface: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Namespace: e.namespace, Name: e.name},
+			Client:     e.client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: e.identity},
+		},
+		ctx:      ctx,
+		stopping: make(chan struct{}),
+		held:     make(chan struct{}),
+	}
+
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            e.lease,
+		LeaseDuration:   e.LeaseDuration,
+		RenewDeadline:   e.RenewDeadline,
+		RetryPeriod:     e.RetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            e.name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) { e.setLeading(true) },
+			OnStoppedLeading: func() { e.setLeading(false) },
+			OnNewLeader: func(identity string) {
+				e.logger.Infof("lease %s/%s is held by %s", e.namespace, e.name, identity)
+			},
+		},
+	})
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to setup leader election: %v", err)
+	}
+
+	e.logger.Infof("campaigning for lease %s/%s as %s", e.namespace, e.name, e.identity)
+
+	e.cancel = cancel
+	go func() {
+		defer close(e.doneCh)
+		le.Run(ctx)
+	}()
+
+	return e, nil
+}
+
+func (e *Elector) setLeading(leading bool) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	switch {
+	case leading && !e.leading:
+		e.logger.Infof("acquired lease %s/%s, leading", e.namespace, e.name)
+		metrics.Leader.Set(1)
+		close(e.leadingCh)
+	case !leading && e.leading:
+		e.logger.Infof("lost lease %s/%s", e.namespace, e.name)
+		metrics.Leader.Set(0)
+		close(e.lostCh)
+	}
+
+	e.leading = leading
+}
+
+// Leading is closed once we acquired the lease
+func (e *Elector) Leading() <-chan struct{} {
+	return e.leadingCh
+}
+
+// Lost is closed when we lost the lease, after having acquired it. A leader
+// can't campaign again: as another replica may have taken over, it must stop
+// writing at once.
+func (e *Elector) Lost() <-chan struct{} {
+	return e.lostCh
+}
+
+// IsLeader tells if we're currently holding the lease
+func (e *Elector) IsLeader() bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.leading
+}
+
+// Stop releases the lease (if held), letting a standby take over at once.
+// Everything guarded by the lease must be stopped first. This may take up
+// to a couple of RetryPeriod, as the next lease attempt is awaited.
+func (e *Elector) Stop() {
+	if e.cancel == nil {
+		return
+	}
+
+	close(e.lease.stopping)
+	select {
+	case <-e.lease.held:
+	case <-e.doneCh:
+	}
+
+	e.cancel()
+	<-e.doneCh
+}
@@ -0,0 +1,118 @@
+package election
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+type mockLog struct{}
+
+func (m *mockLog) Infof(format string, args ...interface{})  {}
+func (m *mockLog) Errorf(format string, args ...interface{}) {}
+
+func newElector(t *testing.T, client *fake.Clientset, identity string) *Elector {
+	e := New(new(mockLog), client, "default", "katafygio", identity)
+	e.LeaseDuration = 2 * time.Second
+	e.RenewDeadline = time.Second
+	e.RetryPeriod = 100 * time.Millisecond
+
+	e, err := e.Start()
+	if err != nil {
+		t.Fatalf("failed to start elector %s: %v", identity, err)
+	}
+
+	return e
+}
+
+func TestElection(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	leader := newElector(t, client, "pod-a")
+	select {
+	case <-leader.Leading():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first replica should acquire the lease")
+	}
+
+	standby := newElector(t, client, "pod-b")
+	defer standby.Stop()
+
+	select {
+	case <-standby.Leading():
+		t.Fatal("a standby shouldn't acquire a lease held by a live leader")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	if !leader.IsLeader() || standby.IsLeader() {
+		t.Error("only one replica should lead")
+	}
+
+	leader.Stop()
+
+	select {
+	case <-leader.Lost():
+	default:
+		t.Error("a stopped leader should report the lease as lost")
+	}
+
+	select {
+	case <-standby.Leading():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the standby should take over a released lease")
+	}
+
+	if leader.IsLeader() || !standby.IsLeader() {
+		t.Error("the standby should now lead")
+	}
+
+	lease, err := client.CoordinationV1().Leases("default").Get("katafygio", metav1.GetOptions{})
+	if err != nil || lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != "pod-b" {
+		t.Errorf("the lease should be held by the new leader (%v)", err)
+	}
+
+	invalid := New(new(mockLog), client, "default", "katafygio", "pod-c")
+	invalid.RenewDeadline = invalid.LeaseDuration
+	if _, err = invalid.Start(); err == nil {
+		t.Error("an elector renewing as late as the lease expires should fail to start")
+	}
+}
+
+func TestElectionRenewFailure(t *testing.T) {
+	client := fake.NewSimpleClientset()
+
+	var failing int32
+	client.PrependReactor("update", "leases", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if atomic.LoadInt32(&failing) == 0 {
+			return false, nil, nil
+		}
+		return true, nil, fmt.Errorf("api server unavailable")
+	})
+
+	leader := newElector(t, client, "pod-a")
+	defer leader.Stop()
+
+	select {
+	case <-leader.Leading():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the replica should acquire the lease")
+	}
+
+	atomic.StoreInt32(&failing, 1)
+
+	select {
+	case <-leader.Lost():
+	case <-time.After(5 * time.Second):
+		t.Fatal("a leader failing to renew its lease should step down")
+	}
+
+	if leader.IsLeader() {
+		t.Error("a leader failing to renew its lease shouldn't lead anymore")
+	}
+}
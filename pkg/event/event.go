@@ -1,6 +1,8 @@
 // Package event mediates notification between controllers and recorder
 package event
 
+import "time"
+
 // Action represents the kind of object change we're notifying
 type Action int
 
@@ -12,12 +14,42 @@ const (
 	Upsert
 )
 
+func (a Action) String() string {
+	if a == Delete {
+		return "delete"
+	}
+	return "upsert"
+}
+
 // Notification conveys an object delete/upsert notification
 type Notification struct {
-	Action Action
-	Key    string
-	Kind   string
-	Object []byte
+	Action   Action
+	Key      string
+	Kind     string
+	Group    string
+	Version  string
+	Object   []byte
+	Author   string // last field manager that changed the object, if known
+	Cluster  string // cluster name, in multi-cluster mode
+	Path     string // file the recorder wrote or removed (absolute), if any
+	Checksum uint64 // checksum of the file the recorder wrote, if any
+}
+
+// QualifiedKind returns the notified object kind, qualified by its API group
+// when not in the core group (ie. "deployment.apps"), as kubectl names them.
+// Kinds are only unique within an API group.
+func (n *Notification) QualifiedKind() string {
+	if n.Group == "" {
+		return n.Kind
+	}
+	return n.Kind + "." + n.Group
+}
+
+// Audit describes who last changed an object, as reported by the API server
+type Audit struct {
+	User string
+	Verb string
+	Time time.Time
 }
 
 // Notifier mediates notifications between controllers and recorder
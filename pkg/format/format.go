@@ -0,0 +1,68 @@
+// Package format defines the output formats objects are dumped in.
+package format
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// Format names an output format
+type Format string
+
+const (
+	// YAML dumps each object in its own yaml file, with sorted keys
+	YAML Format = "yaml"
+
+	// JSON dumps each object in its own (indented) json file
+	JSON Format = "json"
+
+	// MultiDoc dumps all objects of a namespace in a single multi-document
+	// yaml file (cluster scoped objects being grouped in ClusterFile)
+	MultiDoc Format = "multidoc"
+
+	// ClusterFile is the multi-document file holding cluster scoped objects
+	ClusterFile = "_cluster"
+
+	// Separator separates documents in a multi-document yaml file
+	Separator = "---\n"
+)
+
+// Extensions lists the files extensions of all supported formats
+var Extensions = []string{".yaml", ".json"}
+
+// Parse validates a format name
+func Parse(name string) (Format, error) {
+	switch f := Format(strings.ToLower(name)); f {
+	case YAML, JSON, MultiDoc:
+		return f, nil
+	case "":
+		return YAML, nil
+	}
+
+	return "", fmt.Errorf("unsupported output format %q (should be yaml, json or multidoc)", name)
+}
+
+// Marshal serializes an object in the format
+func (f Format) Marshal(obj interface{}) ([]byte, error) {
+	if f == JSON {
+		data, err := json.MarshalIndent(obj, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	}
+
+	// maps keys are sorted, so the same object always yields the same yaml
+	return yaml.Marshal(obj)
+}
+
+// Extension returns the files extension used by the format
+func (f Format) Extension() string {
+	if f == JSON {
+		return ".json"
+	}
+	return ".yaml"
+}
@@ -0,0 +1,37 @@
+package format
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for name, expected := range map[string]Format{"": YAML, "YAML": YAML, "json": JSON, "multidoc": MultiDoc} {
+		f, err := Parse(name)
+		if err != nil || f != expected {
+			t.Errorf("Parse(%q) = %q, %v; expected %q", name, f, err, expected)
+		}
+	}
+
+	if _, err := Parse("xml"); err == nil {
+		t.Error("Parse should fail on unsupported formats")
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	obj := map[string]interface{}{"kind": "Foo", "apiVersion": "v1", "metadata": map[string]interface{}{"name": "bar"}}
+
+	yml, err := YAML.Marshal(obj)
+	if err != nil || string(yml) != "apiVersion: v1\nkind: Foo\nmetadata:\n  name: bar\n" {
+		t.Errorf("unexpected yaml output: %q (%v)", yml, err)
+	}
+
+	js, err := JSON.Marshal(obj)
+	expected := "{\n  \"apiVersion\": \"v1\",\n  \"kind\": \"Foo\",\n  \"metadata\": {\n    \"name\": \"bar\"\n  }\n}\n"
+	if err != nil || string(js) != expected {
+		t.Errorf("unexpected json output: %q (%v)", js, err)
+	}
+
+	if YAML.Extension() != ".yaml" || MultiDoc.Extension() != ".yaml" || JSON.Extension() != ".json" {
+		t.Error("unexpected formats extensions")
+	}
+}
@@ -1,13 +1,35 @@
-// Package health serves health checks over HTTP at /health endpoint.
+// Package health serves health checks over HTTP: liveness at /healthz (and
+// /health, for backward compatibility), and readiness at /readyz. Both are
+// backed by checks registered by the other components; the detailed checks
+// results are returned as JSON when the "verbose" query parameter is set.
+//
+// Other handlers (ie. metrics, or the audit webhook receiver) may share the
+// same listener.
 package health
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
+	"sync"
 )
 
+// Check reports a component health: nil means healthy
+type Check func() error
+
+type checkResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type checksReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
 type logger interface {
 	Infof(format string, args ...interface{})
 	Errorf(format string, args ...interface{})
@@ -18,7 +40,12 @@ type Listener struct {
 	logger logger
 	port   int
 	donech chan struct{}
+	mux    *http.ServeMux
 	srv    *http.Server
+
+	checksLock sync.RWMutex
+	liveness   map[string]Check
+	readiness  map[string]Check
 }
 
 // New create a new http health check listener
@@ -27,12 +54,82 @@ func New(log logger, port int) *Listener {
 		logger: log,
 		port:   port,
 		donech: make(chan struct{}),
+		mux:    http.NewServeMux(),
 		srv:    nil,
+
+		liveness:  make(map[string]Check),
+		readiness: make(map[string]Check),
 	}
 }
 
+// AddLivenessCheck registers a check failing when the process should be restarted
+func (h *Listener) AddLivenessCheck(name string, check Check) *Listener {
+	h.checksLock.Lock()
+	defer h.checksLock.Unlock()
+	h.liveness[name] = check
+	return h
+}
+
+// AddReadinessCheck registers a check failing while we're not (yet) doing our job
+func (h *Listener) AddReadinessCheck(name string, check Check) *Listener {
+	h.checksLock.Lock()
+	defer h.checksLock.Unlock()
+	h.readiness[name] = check
+	return h
+}
+
+// Handle registers an additional handler, to be served by the listener once started
+func (h *Listener) Handle(pattern string, handler http.Handler) *Listener {
+	h.mux.Handle(pattern, handler)
+	return h
+}
+
 func (h *Listener) healthCheckReply(w http.ResponseWriter, r *http.Request) {
-	if _, err := io.WriteString(w, "ok\n"); err != nil {
+	h.checksReply(w, r, h.liveness)
+}
+
+func (h *Listener) readinessReply(w http.ResponseWriter, r *http.Request) {
+	h.checksReply(w, r, h.readiness)
+}
+
+func (h *Listener) checksReply(w http.ResponseWriter, r *http.Request, checks map[string]Check) {
+	report := checksReport{Status: "ok", Checks: make(map[string]checkResult)}
+	var failures []string
+
+	h.checksLock.RLock()
+	for name, check := range checks {
+		res := checkResult{OK: true}
+		if err := check(); err != nil {
+			res = checkResult{OK: false, Error: err.Error()}
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+			report.Status = "failed"
+		}
+		report.Checks[name] = res
+	}
+	h.checksLock.RUnlock()
+
+	_, verbose := r.URL.Query()["verbose"]
+	if verbose {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
+	if len(failures) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	var err error
+	if verbose {
+		err = json.NewEncoder(w).Encode(report)
+	} else if len(failures) > 0 {
+		sort.Strings(failures)
+		for _, failure := range failures {
+			_, err = io.WriteString(w, failure+"\n")
+		}
+	} else {
+		_, err = io.WriteString(w, "ok\n")
+	}
+
+	if err != nil {
 		h.logger.Errorf("Failed to reply to http healtcheck from %s: %s\n", r.RemoteAddr, err)
 	}
 }
@@ -45,9 +142,10 @@ func (h *Listener) Start() *Listener {
 
 	h.logger.Infof("Starting http healtcheck handler")
 
-	h.srv = &http.Server{Addr: fmt.Sprintf(":%d", h.port)}
-
-	http.HandleFunc("/health", h.healthCheckReply)
+	h.mux.HandleFunc("/health", h.healthCheckReply)
+	h.mux.HandleFunc("/healthz", h.healthCheckReply)
+	h.mux.HandleFunc("/readyz", h.readinessReply)
+	h.srv = &http.Server{Addr: fmt.Sprintf(":%d", h.port), Handler: h.mux}
 
 	go func() {
 		defer close(h.donech)
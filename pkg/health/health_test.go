@@ -1,6 +1,8 @@
 package health
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -40,3 +42,62 @@ func TestHealthCheck(t *testing.T) {
 		t.Errorf("healthCheckReply handler didn't return an HTTP 200 status code")
 	}
 }
+
+func TestHandle(t *testing.T) {
+	hc := New(logs, 0).Handle("/foo", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	req, err := http.NewRequest("POST", "/foo", nil)
+	if err != nil {
+		t.Error(err)
+	}
+
+	rr := httptest.NewRecorder()
+	hc.mux.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusAccepted {
+		t.Errorf("registered handlers should be served, got HTTP %d", status)
+	}
+}
+
+func TestChecks(t *testing.T) {
+	hc := New(logs, 0).
+		AddLivenessCheck("alive", func() error { return nil }).
+		AddReadinessCheck("alive", func() error { return nil }).
+		AddReadinessCheck("sync", func() error { return fmt.Errorf("pending") })
+
+	for _, tt := range []struct {
+		url  string
+		code int
+		body string
+	}{
+		{"/healthz", http.StatusOK, "ok\n"},
+		{"/health", http.StatusOK, "ok\n"},
+		{"/readyz", http.StatusServiceUnavailable, "sync: pending\n"},
+	} {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", tt.url, nil)
+		if tt.url == "/readyz" {
+			hc.readinessReply(rr, req)
+		} else {
+			hc.healthCheckReply(rr, req)
+		}
+
+		if rr.Code != tt.code || rr.Body.String() != tt.body {
+			t.Errorf("%s: expected %d %q, got %d %q", tt.url, tt.code, tt.body, rr.Code, rr.Body.String())
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	hc.readinessReply(rr, httptest.NewRequest("GET", "/readyz?verbose", nil))
+
+	var report checksReport
+	if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+		t.Fatalf("verbose mode should return json: %v", err)
+	}
+
+	if report.Status != "failed" || !report.Checks["alive"].OK || report.Checks["sync"].Error != "pending" {
+		t.Errorf("unexpected detailed report: %+v", report)
+	}
+}
@@ -0,0 +1,191 @@
+// Package metrics defines the Prometheus metrics katafygio components update,
+// and exposes them over HTTP (on the health listener's /metrics endpoint).
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const namespace = "katafygio"
+
+var (
+	// Registry holds all katafygio metrics
+	Registry = prometheus.NewRegistry()
+
+	// Events counts the objects notifications sent by controllers. The
+	// cluster label (as the other per-cluster metrics' one) names the
+	// cluster in multi-cluster mode, and is empty otherwise.
+	Events = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_total",
+		Help:      "Objects change notifications sent by controllers, by cluster, kind and action.",
+	}, []string{"cluster", "kind", "action"})
+
+	// RecorderWrites counts the files written by the recorder
+	RecorderWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "recorder",
+		Name:      "writes_total",
+		Help:      "Files written (or removed) on disk by the recorder, by cluster.",
+	}, []string{"cluster"})
+
+	// RecorderSkips counts the writes skipped because the file didn't change
+	RecorderSkips = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "recorder",
+		Name:      "skips_total",
+		Help:      "Files writes skipped because the content didn't change, by cluster.",
+	}, []string{"cluster"})
+
+	// RecorderGCDeletions counts the stale files garbage collected by the recorder
+	RecorderGCDeletions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "recorder",
+		Name:      "gc_deletions_total",
+		Help:      "Stale files removed by the recorder garbage collection, by cluster.",
+	}, []string{"cluster"})
+
+	// GitDuration observes the git operations durations
+	GitDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "git",
+		Name:      "duration_seconds",
+		Help:      "Duration of git operations, by operation (commit or push).",
+		Buckets:   []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300},
+	}, []string{"operation"})
+
+	// GitFailures counts the failed git operations
+	GitFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "git",
+		Name:      "failures_total",
+		Help:      "Failed git operations, by operation (commit, pull or push).",
+	}, []string{"operation"})
+
+	// GitConflicted tells if the local and remote git histories diverged
+	// and couldn't be reconciled
+	GitConflicted = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "git",
+		Name:      "conflicted",
+		Help:      "Whether the local and remote repositories histories diverged, and couldn't be reconciled (1) or not (0).",
+	})
+
+	// Controllers tracks the number of running controllers
+	Controllers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "controllers",
+		Help:      "Number of running controllers (watched resources kinds), by cluster.",
+	}, []string{"cluster"})
+
+	// Leader tells if we're the elected leader, when leader election is enabled
+	Leader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "leader",
+		Help:      "Whether this replica holds the leader election lease (1) or not (0).",
+	})
+
+	queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "depth",
+		Help:      "Current depth of the controllers workqueues.",
+	}, []string{"name"})
+
+	queueAdds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "adds_total",
+		Help:      "Items added to the controllers workqueues.",
+	}, []string{"name"})
+
+	queueLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "queue_duration_seconds",
+		Help:      "How long items stay in the workqueues before being processed.",
+		Buckets:   prometheus.ExponentialBuckets(10e-6, 10, 8),
+	}, []string{"name"})
+
+	queueWorkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "work_duration_seconds",
+		Help:      "How long processing an item from the workqueues takes.",
+		Buckets:   prometheus.ExponentialBuckets(10e-6, 10, 8),
+	}, []string{"name"})
+
+	queueUnfinished = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "unfinished_work_seconds",
+		Help:      "Seconds of work in progress, not yet observed by work_duration.",
+	}, []string{"name"})
+
+	queueLongestRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "longest_running_processor_seconds",
+		Help:      "How long the longest running processor has been running.",
+	}, []string{"name"})
+
+	queueRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "workqueue",
+		Name:      "retries_total",
+		Help:      "Items re-queued, by workqueue, after processing failures.",
+	}, []string{"name"})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		Events, RecorderWrites, RecorderSkips, RecorderGCDeletions,
+		GitDuration, GitFailures, GitConflicted, Controllers, Leader,
+		queueDepth, queueAdds, queueLatency, queueWorkDuration,
+		queueUnfinished, queueLongestRunning, queueRetries,
+	)
+
+	workqueue.SetProvider(queueMetrics{})
+}
+
+// Handler serves the metrics
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// queueMetrics exposes the (named) workqueues metrics
+type queueMetrics struct{}
+
+func (queueMetrics) NewDepthMetric(name string) workqueue.GaugeMetric {
+	return queueDepth.WithLabelValues(name)
+}
+
+func (queueMetrics) NewAddsMetric(name string) workqueue.CounterMetric {
+	return queueAdds.WithLabelValues(name)
+}
+
+func (queueMetrics) NewLatencyMetric(name string) workqueue.HistogramMetric {
+	return queueLatency.WithLabelValues(name)
+}
+
+func (queueMetrics) NewWorkDurationMetric(name string) workqueue.HistogramMetric {
+	return queueWorkDuration.WithLabelValues(name)
+}
+
+func (queueMetrics) NewUnfinishedWorkSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return queueUnfinished.WithLabelValues(name)
+}
+
+func (queueMetrics) NewLongestRunningProcessorSecondsMetric(name string) workqueue.SettableGaugeMetric {
+	return queueLongestRunning.WithLabelValues(name)
+}
+
+func (queueMetrics) NewRetriesMetric(name string) workqueue.CounterMetric {
+	return queueRetries.WithLabelValues(name)
+}
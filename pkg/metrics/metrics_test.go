@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestHandler(t *testing.T) {
+	queue := workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "foo")
+	queue.Add("bar")
+	queue.AddRateLimited("baz")
+	defer queue.ShutDown()
+
+	Events.WithLabelValues("prod", "deployment", "upsert").Inc()
+	Controllers.WithLabelValues("prod").Set(2)
+	GitFailures.WithLabelValues("push").Inc()
+
+	rr := httptest.NewRecorder()
+	Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, _ := ioutil.ReadAll(rr.Body)
+	for _, metric := range []string{
+		`katafygio_events_total{action="upsert",cluster="prod",kind="deployment"} 1`,
+		`katafygio_git_failures_total{operation="push"} 1`,
+		`katafygio_workqueue_depth{name="foo"} 1`,
+		`katafygio_workqueue_adds_total{name="foo"} 1`,
+		`katafygio_workqueue_retries_total{name="foo"} 1`,
+		`katafygio_controllers{cluster="prod"} 2`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(string(body), metric) {
+			t.Errorf("metrics should expose %s", metric)
+		}
+	}
+}
@@ -5,12 +5,15 @@
 package observer
 
 import (
+	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/bpineau/katafygio/pkg/controller"
 	"github.com/bpineau/katafygio/pkg/event"
+	"github.com/bpineau/katafygio/pkg/metrics"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -26,7 +29,7 @@ const discoveryInterval = 60 * time.Second
 
 // ControllerFactory make controllers generation interchangeable
 type ControllerFactory interface {
-	NewController(client cache.ListerWatcher, notifier event.Notifier, name string) controller.Interface
+	NewController(client cache.ListerWatcher, notifier event.Notifier, gvk schema.GroupVersionKind, cluster string) controller.Interface
 }
 
 type controllerCollection map[string]controller.Interface
@@ -53,6 +56,7 @@ type Observer struct {
 	logger       logger
 	excludedkind []string
 	namespace    string
+	cluster      string
 }
 
 type gvk struct {
@@ -62,8 +66,10 @@ type gvk struct {
 
 type resources map[string]*gvk
 
-// New returns a new observer, that will watch API resources and create controllers
-func New(log logger, client restclient, notif event.Notifier, factory ControllerFactory, excluded []string, namespace string) *Observer {
+// New returns a new observer, that will watch API resources and create controllers.
+// cluster names the observed cluster, in multi-cluster mode.
+func New(log logger, client restclient, notif event.Notifier, factory ControllerFactory, excluded []string,
+	namespace, cluster string) *Observer {
 	return &Observer{
 		notifier:     notif,
 		discovery:    discovery.NewDiscoveryClientForConfigOrDie(client.GetRestConfig()),
@@ -73,6 +79,7 @@ func New(log logger, client restclient, notif event.Notifier, factory Controller
 		logger:       log,
 		excludedkind: excluded,
 		namespace:    namespace,
+		cluster:      cluster,
 	}
 }
 
@@ -115,11 +122,36 @@ func (c *Observer) Stop() {
 	for _, ct := range c.ctrls {
 		ct.Stop()
 	}
+	metrics.Controllers.WithLabelValues(c.cluster).Sub(float64(len(c.ctrls)))
 	c.RUnlock()
 
 	<-c.doneCh
 }
 
+// Ready tells if all the controllers completed their initial sync
+func (c *Observer) Ready() error {
+	c.RLock()
+	defer c.RUnlock()
+
+	if len(c.ctrls) == 0 {
+		return fmt.Errorf("no controller started yet")
+	}
+
+	var pending []string
+	for name, ct := range c.ctrls {
+		if !ct.Synced() {
+			pending = append(pending, name)
+		}
+	}
+
+	if len(pending) > 0 {
+		sort.Strings(pending)
+		return fmt.Errorf("initial sync pending for %s", strings.Join(pending, ", "))
+	}
+
+	return nil
+}
+
 func (c *Observer) refresh() error {
 	c.Lock()
 	defer c.Unlock()
@@ -140,7 +172,6 @@ func (c *Observer) refresh() error {
 			Resource: res.apiResource.Name,
 		}
 
-		cname := strings.ToLower(res.apiResource.Kind)
 		namespace := metav1.NamespaceAll
 		if c.namespace != "" {
 			namespace = c.namespace
@@ -154,8 +185,10 @@ func (c *Observer) refresh() error {
 			},
 		}
 
-		c.ctrls[name] = c.factory.NewController(lw, c.notifier, cname)
+		c.ctrls[name] = c.factory.NewController(lw, c.notifier, res.groupVersion.WithKind(res.apiResource.Kind), c.cluster)
 		go c.ctrls[name].Start()
+
+		metrics.Controllers.WithLabelValues(c.cluster).Inc()
 	}
 
 	return nil
@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/bpineau/katafygio/pkg/controller"
@@ -13,6 +14,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	extv1beta1 "k8s.io/api/extensions/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	_ "k8s.io/apimachinery/pkg/version"
 	fakediscovery "k8s.io/client-go/discovery/fake"
 	fakeclientset "k8s.io/client-go/kubernetes/fake"
@@ -34,12 +36,14 @@ type mockCtrl struct{}
 func (m *mockCtrl) Start() {}
 func (m *mockCtrl) Stop()  {}
 
+func (m *mockCtrl) Synced() bool { return true }
+
 type mockFactory struct {
 	names []string
 }
 
-func (m *mockFactory) NewController(client cache.ListerWatcher, notifier event.Notifier, name string) controller.Interface {
-	m.names = append(m.names, name)
+func (m *mockFactory) NewController(client cache.ListerWatcher, notifier event.Notifier, gvk schema.GroupVersionKind, cluster string) controller.Interface {
+	m.names = append(m.names, strings.ToLower(gvk.Kind))
 	return &mockCtrl{}
 }
 
@@ -191,7 +195,7 @@ var resourcesTests = []resTest{
 func TestObserver(t *testing.T) {
 	for _, tt := range resourcesTests {
 		factory := new(mockFactory)
-		obs := New(new(mockLog), new(mockClient), &mockNotifier{}, factory, tt.exclude, tt.namespace)
+		obs := New(new(mockLog), new(mockClient), &mockNotifier{}, factory, tt.exclude, tt.namespace, "")
 
 		client := fakeclientset.NewSimpleClientset()
 		fakeDiscovery, _ := client.Discovery().(*fakediscovery.FakeDiscovery)
@@ -232,13 +236,21 @@ func TestObserverDuplicas(t *testing.T) {
 	fakeDiscovery.Resources = duplicatesTest
 
 	factory := new(mockFactory)
-	obs := New(new(mockLog), new(mockClient), &mockNotifier{}, factory, make([]string, 0), "")
+	obs := New(new(mockLog), new(mockClient), &mockNotifier{}, factory, make([]string, 0), "", "")
+	if obs.Ready() == nil {
+		t.Error("observer shouldn't be ready before starting controllers")
+	}
+
 	obs.discovery = fakeDiscovery
 	obs.Start()
 	err := obs.refresh()
 	if err != nil {
 		t.Errorf("refresh failed: %v", err)
 	}
+
+	if err = obs.Ready(); err != nil {
+		t.Errorf("observer should be ready once all controllers synced: %v", err)
+	}
 	obs.Stop()
 
 	expected := []string{"pod", "replicaset", "deployment"}
@@ -262,7 +274,7 @@ func TestObserverRecoverFromDicoveryFailure(t *testing.T) {
 	}
 
 	factory := new(mockFactory)
-	obs := New(new(mockLog), new(mockClient), &mockNotifier{}, factory, make([]string, 0), "")
+	obs := New(new(mockLog), new(mockClient), &mockNotifier{}, factory, make([]string, 0), "", "")
 
 	// failing discovery
 	obs.discovery.RESTClient().(*rest.RESTClient).Client = fakeClient.Client
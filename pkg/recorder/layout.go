@@ -0,0 +1,245 @@
+package recorder
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/ghodss/yaml"
+	"github.com/spf13/afero"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/bpineau/katafygio/pkg/event"
+	"github.com/bpineau/katafygio/pkg/format"
+)
+
+// ClusterDir holds the cluster scoped objects, when using a layout template
+const ClusterDir = "_cluster"
+
+// Layout decides where objects are saved, relative to the local directory
+type Layout struct {
+	output format.Format
+	tmpl   *template.Template
+	legacy bool
+}
+
+// PathData is the data available to layout templates
+type PathData struct {
+	Group     string
+	Version   string
+	Kind      string // lowercased, ie. "deployment"
+	Namespace string // ClusterDir for cluster scoped objects
+	Name      string
+
+	// QualifiedKind is the kind qualified by its API group, ie.
+	// "deployment.apps" (kinds are only unique within an API group)
+	QualifiedKind string
+}
+
+// mover moves files within the local directory (ie. with "git mv")
+type mover interface {
+	Move(from, to string) error
+}
+
+// NewLayout returns a Layout for the output format. The optional text
+// template (ie. "{{.Namespace}}/{{.QualifiedKind}}/{{.Name}}.yaml") is rendered with
+// PathData; the format's extension is appended when missing. Without a
+// template, objects are saved as "<namespace>/<kind>.<group>-<name>" (or as
+// "<namespace>/<kind>-<name>" for the core group, or when legacyNames is
+// set), and cluster scoped objects at the root. Templates are ignored by the
+// multidoc format.
+func NewLayout(text string, output format.Format, legacyNames bool) (*Layout, error) {
+	l := &Layout{output: output, legacy: legacyNames}
+	if text == "" || output == format.MultiDoc {
+		return l, nil
+	}
+
+	tmpl, err := template.New("layout").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid layout template: %v", err)
+	}
+
+	// catch errors early, rather than when saving objects
+	if _, err = l.render(tmpl, PathData{}); err != nil {
+		return nil, fmt.Errorf("invalid layout template: %v", err)
+	}
+
+	l.tmpl = tmpl
+	return l, nil
+}
+
+// Format returns the layout's output format
+func (l *Layout) Format() format.Format {
+	return l.output
+}
+
+// Path returns an object's path, relative to the local directory
+func (l *Layout) Path(data PathData) string {
+	if l.output == format.MultiDoc {
+		// all objects of a namespace share a file
+		name := format.ClusterFile
+		if data.Namespace != "" && data.Namespace != ClusterDir {
+			name = data.Namespace
+		}
+		return name + l.output.Extension()
+	}
+
+	data.QualifiedKind = (&event.Notification{Kind: data.Kind, Group: data.Group}).QualifiedKind()
+
+	if l.tmpl == nil {
+		if data.Namespace == ClusterDir {
+			data.Namespace = ""
+		}
+		kind := data.QualifiedKind
+		if l.legacy {
+			kind = data.Kind
+		}
+		return filepath.Join(data.Namespace, kind+"-"+data.Name+l.output.Extension())
+	}
+
+	if data.Namespace == "" {
+		data.Namespace = ClusterDir
+	}
+
+	// the template was validated at creation
+	path, _ := l.render(l.tmpl, data)
+	return path
+}
+
+func (l *Layout) render(tmpl *template.Template, data PathData) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+
+	path := strings.TrimSpace(buf.String())
+	for _, ext := range format.Extensions {
+		path = strings.TrimSuffix(path, ext)
+	}
+
+	return filepath.Clean("/" + path + l.output.Extension())[1:], nil
+}
+
+// notifPath returns the path data of a notified object
+func notifPath(ev *event.Notification) PathData {
+	data := PathData{Group: ev.Group, Version: ev.Version, Kind: ev.Kind, Name: filepath.Base(ev.Key)}
+	if strings.Contains(ev.Key, "/") {
+		data.Namespace = filepath.Dir(ev.Key)
+	}
+	return data
+}
+
+// Migrate moves the files found in the local directory to the location the
+// layout expects them (ie. after a layout or format change), using mover when
+// provided (ie. with "git mv", so history is preserved). Must be called
+// before Start (or, for held recorders, is called by Release).
+func (w *Listener) Migrate(mv mover) error {
+	if w.dryRun || w.layout.Format() == format.MultiDoc {
+		return nil
+	}
+
+	root, err := filepath.Abs(w.localDir)
+	if err != nil {
+		return err
+	}
+
+	moves := make(map[string]string)
+	err = afero.Walk(appFs, root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
+		if info.IsDir() || !isManifest(path) || filepath.Ext(path) != w.layout.Format().Extension() {
+			return nil
+		}
+
+		data, ok := readPathData(path)
+		if !ok {
+			return nil
+		}
+
+		target := filepath.Join(root, w.layout.Path(data))
+		if target != path {
+			moves[path] = target
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk %s: %v", root, err)
+	}
+
+	for from, to := range moves {
+		if exists, _ := afero.Exists(appFs, to); exists {
+			continue // will be garbage collected
+		}
+
+		if err := appFs.MkdirAll(filepath.Dir(to), 0700); err != nil {
+			return fmt.Errorf("can't create local directory %s: %v", filepath.Dir(to), err)
+		}
+
+		if mv != nil {
+			if err := mv.Move(from, to); err == nil {
+				continue
+			}
+		}
+
+		// untracked files, or stores without a move support
+		if err := appFs.Rename(from, to); err != nil {
+			return fmt.Errorf("failed to move %s to %s: %v", from, to, err)
+		}
+	}
+
+	if len(moves) > 0 {
+		w.logger.Infof("Moved %d files to match the directory layout", len(moves))
+	}
+
+	return nil
+}
+
+// readPathData reads the path data of a dumped object, if the file holds
+// a single object.
+func readPathData(path string) (PathData, bool) {
+	content, err := afero.ReadFile(appFs, path)
+	if err != nil || len(splitDocuments(content)) > 1 {
+		return PathData{}, false
+	}
+
+	return parsePathData(content)
+}
+
+// parsePathData returns the path data of a serialized object
+func parsePathData(content []byte) (PathData, bool) {
+	var obj struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+		Metadata   struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"metadata"`
+	}
+
+	if err := yaml.Unmarshal(content, &obj); err != nil || obj.Kind == "" || obj.Metadata.Name == "" {
+		return PathData{}, false
+	}
+
+	gv, err := schema.ParseGroupVersion(obj.APIVersion)
+	if err != nil {
+		return PathData{}, false
+	}
+
+	return PathData{
+		Group:     gv.Group,
+		Version:   gv.Version,
+		Kind:      strings.ToLower(obj.Kind),
+		Namespace: obj.Metadata.Namespace,
+		Name:      obj.Metadata.Name,
+	}, true
+}
@@ -0,0 +1,187 @@
+package recorder
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/afero"
+
+	"github.com/bpineau/katafygio/pkg/event"
+	"github.com/bpineau/katafygio/pkg/format"
+	"github.com/bpineau/katafygio/pkg/metrics"
+)
+
+// documents holds a multi-document file content, by object ("qualified-kind/key")
+type documents struct {
+	objects map[string][]byte
+
+	// objects loaded from disk, not seen in the cluster since
+	stale map[string]bool
+}
+
+// saveDocument updates (or removes) an object in a multi-document file
+func (w *Listener) saveDocument(file string, ev *event.Notification) (changed bool, err error) {
+	if w.dryRun {
+		return false, nil
+	}
+
+	w.activesLock.Lock()
+	defer w.activesLock.Unlock()
+
+	docs, err := w.loadDocuments(file)
+	if err != nil {
+		return false, err
+	}
+
+	id := ev.QualifiedKind() + "/" + ev.Key
+	prev, exists := docs.objects[id]
+	delete(docs.stale, id)
+
+	switch ev.Action {
+	case event.Upsert:
+		if exists && bytes.Equal(prev, ev.Object) {
+			metrics.RecorderSkips.WithLabelValues(w.cluster).Inc()
+			return false, nil
+		}
+		docs.objects[id] = ev.Object
+	case event.Delete:
+		if !exists {
+			return false, nil
+		}
+		delete(docs.objects, id)
+	}
+
+	if err = w.writeDocuments(file, docs); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// loadDocuments returns a multi-document file content, reading it from
+// disk the first time (so restarts don't rewrite unchanged files).
+func (w *Listener) loadDocuments(file string) (*documents, error) {
+	if docs, ok := w.docs[file]; ok {
+		return docs, nil
+	}
+
+	docs := &documents{objects: make(map[string][]byte), stale: make(map[string]bool)}
+
+	data, err := afero.ReadFile(appFs, file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %v", file, err)
+	}
+
+	for _, doc := range splitDocuments(data) {
+		data, ok := parsePathData(doc)
+		if !ok {
+			continue // will be dropped on next write
+		}
+
+		key := data.Name
+		if data.Namespace != "" {
+			key = data.Namespace + "/" + key
+		}
+
+		id := (&event.Notification{Kind: data.Kind, Group: data.Group}).QualifiedKind() + "/" + key
+		docs.objects[id] = doc
+		docs.stale[id] = true
+	}
+
+	if len(data) > 0 {
+		w.actives[w.relativePath(file)] = Checksum(data)
+	}
+
+	w.docs[file] = docs
+	return docs, nil
+}
+
+// writeDocuments writes a multi-document file (with objects sorted, so the
+// file content is stable), or removes it when it's empty.
+func (w *Listener) writeDocuments(file string, docs *documents) error {
+	rel := w.relativePath(file)
+
+	if len(docs.objects) == 0 {
+		delete(w.actives, rel)
+		delete(w.docs, file)
+		if err := appFs.Remove(filepath.Clean(file)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		metrics.RecorderWrites.WithLabelValues(w.cluster).Inc()
+		return nil
+	}
+
+	ids := make([]string, 0, len(docs.objects))
+	for id := range docs.objects {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var buf bytes.Buffer
+	for _, id := range ids {
+		buf.WriteString(format.Separator)
+		buf.Write(docs.objects[id])
+	}
+
+	if err := writeFile(file, buf.Bytes()); err != nil {
+		return err
+	}
+
+	w.actives[rel] = Checksum(buf.Bytes())
+	metrics.RecorderWrites.WithLabelValues(w.cluster).Inc()
+	return nil
+}
+
+// deleteObsoleteDocuments removes the objects we found in multi-document
+// files but that weren't seen in the cluster since.
+func (w *Listener) deleteObsoleteDocuments() {
+	if w.dryRun {
+		return
+	}
+
+	w.activesLock.Lock()
+	defer w.activesLock.Unlock()
+
+	for file, docs := range w.docs {
+		if len(docs.stale) == 0 {
+			continue
+		}
+
+		for id := range docs.stale {
+			delete(docs.objects, id)
+		}
+		deleted := len(docs.stale)
+		docs.stale = make(map[string]bool)
+
+		if err := w.writeDocuments(file, docs); err != nil {
+			w.logger.Errorf("failed to gc some objects from %s: %v", file, err)
+			continue
+		}
+		metrics.RecorderGCDeletions.WithLabelValues(w.cluster).Add(float64(deleted))
+		if sum, ok := w.actives[w.relativePath(file)]; ok {
+			w.touched(event.Upsert, file, sum)
+		} else {
+			w.touched(event.Delete, file, 0) // no document left
+		}
+	}
+}
+
+// splitDocuments splits a multi-document yaml file. Marshalled objects
+// can't contain a separator line, as multi-lines strings are indented.
+func splitDocuments(data []byte) [][]byte {
+	var docs [][]byte
+	for _, doc := range bytes.Split(append([]byte("\n"), data...), []byte("\n"+format.Separator)) {
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		doc = append([]byte{}, doc...)
+		if !bytes.HasSuffix(doc, []byte("\n")) {
+			doc = append(doc, '\n')
+		}
+		docs = append(docs, doc)
+	}
+	return docs
+}
@@ -7,6 +7,7 @@ import (
 	"hash/crc64"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -14,6 +15,8 @@ import (
 	"github.com/spf13/afero"
 
 	"github.com/bpineau/katafygio/pkg/event"
+	"github.com/bpineau/katafygio/pkg/format"
+	"github.com/bpineau/katafygio/pkg/metrics"
 )
 
 var (
@@ -26,34 +29,60 @@ type logger interface {
 	Errorf(format string, args ...interface{})
 }
 
+// changelog receives the notifications that effectively changed the local
+// directory content (ie. to describe them in commit messages), including the
+// touched files paths and checksums. Garbage collected files are notified
+// with a path only.
+type changelog interface {
+	Send(notif *event.Notification)
+}
+
 // activeFiles will contain a list of active (present in cluster) objects; we'll
 // use that to periodically find and garbage collect stale objets in the git repos
 // (ie. if some objects were delete from cluster while katafygio was not running),
 // and to skip already existing and unchanged files.
 type activeFiles map[string]uint64
 
-// Listener receive events from controllers and save them to disk as yaml files
+// Listener receive events from controllers and save them to disk as yaml
+// (or json) files
 type Listener struct {
 	logger      logger
 	events      event.Notifier
+	changes     changelog
 	actives     activeFiles
 	activesLock sync.RWMutex
+	docs        map[string]*documents
 	localDir    string
+	cluster     string
+	layout      *Layout
 	gcInterval  time.Duration
 	dryRun      bool
+	held        map[string]event.Notification // latest events, while held
+	releasech   chan mover
+	releasedch  chan error
 	stopch      chan struct{}
 	donech      chan struct{}
 }
 
-// New creates a new event Listener
-func New(log logger, events event.Notifier, localDir string, gcInterval int, dryRun bool) *Listener {
+// New creates a new event Listener. changes is optional, and will be notified
+// of the events that changed the local directory content. The layout's output
+// format must match the controllers' one. cluster labels the metrics, in
+// multi-cluster mode.
+func New(log logger, events event.Notifier, changes changelog, localDir string, layout *Layout,
+	gcInterval int, dryRun bool, cluster string) *Listener {
 	return &Listener{
 		logger:     log,
 		events:     events,
+		changes:    changes,
 		actives:    activeFiles{},
+		docs:       make(map[string]*documents),
 		localDir:   localDir,
+		cluster:    cluster,
+		layout:     layout,
 		dryRun:     dryRun,
 		gcInterval: time.Duration(gcInterval) * time.Second,
+		releasech:  make(chan mover),
+		releasedch: make(chan error),
 		stopch:     make(chan struct{}),
 		donech:     make(chan struct{}),
 	}
@@ -74,9 +103,17 @@ func (w *Listener) Start() *Listener {
 			case <-w.stopch:
 				return
 			case ev := <-evCh:
+				if w.held != nil {
+					w.held[ev.QualifiedKind()+":"+ev.Key] = ev
+					continue
+				}
 				w.processNextEvent(&ev)
+			case mv := <-w.releasech:
+				w.releasedch <- w.release(mv)
 			case <-gcTick.C:
-				w.deleteObsoleteFiles()
+				if w.held == nil {
+					w.deleteObsoleteFiles()
+				}
 			}
 		}
 	}()
@@ -84,6 +121,46 @@ func (w *Listener) Start() *Listener {
 	return w
 }
 
+// Hold keeps the latest event of each object in memory, without touching the
+// local directory, until Release is called (ie. on standby replicas, which
+// must not write while an other replica leads). Must be called before Start.
+func (w *Listener) Hold() *Listener {
+	w.held = make(map[string]event.Notification)
+	return w
+}
+
+// Release migrates the local directory files (see Migrate), then saves the
+// events kept since Hold, and resumes writing the incoming ones
+func (w *Listener) Release(mv mover) error {
+	w.releasech <- mv
+	return <-w.releasedch
+}
+
+func (w *Listener) release(mv mover) error {
+	err := appFs.MkdirAll(filepath.Clean(w.localDir), 0700)
+	if err != nil {
+		return fmt.Errorf("can't create directory %s: %v", w.localDir, err)
+	}
+
+	if err = w.Migrate(mv); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(w.held))
+	for key := range w.held {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		ev := w.held[key]
+		w.processNextEvent(&ev)
+	}
+	w.held = nil
+
+	return nil
+}
+
 // Stop halts the recorder service
 func (w *Listener) Stop() {
 	w.logger.Infof("Stopping event recorder")
@@ -92,43 +169,66 @@ func (w *Listener) Stop() {
 }
 
 func (w *Listener) processNextEvent(ev *event.Notification) {
-	path, err := getPath(w.localDir, ev)
+	path, err := getPath(w.localDir, w.layout, ev)
 	if err != nil {
 		w.logger.Errorf("failed to get %s path: %v", ev.Key, err)
 	}
 
-	switch ev.Action {
-	case event.Upsert:
-		err = w.save(path, ev.Object)
-	case event.Delete:
-		err = w.remove(path)
+	changed := false
+	switch {
+	case w.layout.Format() == format.MultiDoc:
+		changed, err = w.saveDocument(path, ev)
+	case ev.Action == event.Upsert:
+		changed, err = w.save(path, ev.Object)
+	case ev.Action == event.Delete:
+		changed, err = w.remove(path)
 	}
 
 	if err != nil {
 		w.logger.Errorf("failed to delete or save %s: %v", ev.Key, err)
 	}
-}
 
-func getPath(root string, ev *event.Notification) (string, error) {
-	filename := ev.Kind + "-" + filepath.Base(ev.Key) + ".yaml"
+	if changed && w.changes != nil {
+		w.activesLock.RLock()
+		sum := w.actives[w.relativePath(path)]
+		w.activesLock.RUnlock()
 
-	dir, err := filepath.Abs(filepath.Dir(root + "/" + ev.Key))
-	if err != nil {
-		return "", err
+		w.changes.Send(&event.Notification{Action: ev.Action, Key: ev.Key, Kind: ev.Kind,
+			Group: ev.Group, Version: ev.Version, Author: ev.Author, Path: path, Checksum: sum})
 	}
+}
+
+// touched notifies the changelog of a file we changed outside of an object
+// event (ie. garbage collected)
+func (w *Listener) touched(action event.Action, path string, sum uint64) {
+	if w.changes != nil {
+		w.changes.Send(&event.Notification{Action: action, Path: path, Checksum: sum})
+	}
+}
 
-	return dir + "/" + filename, nil
+func getPath(root string, layout *Layout, ev *event.Notification) (string, error) {
+	return filepath.Abs(root + "/" + layout.Path(notifPath(ev)))
 }
 
-func (w *Listener) remove(file string) error {
+func (w *Listener) remove(file string) (changed bool, err error) {
 	if w.dryRun {
-		return nil
+		return false, nil
 	}
 
 	w.activesLock.Lock()
-	delete(w.actives, file)
+	delete(w.actives, w.relativePath(file))
 	w.activesLock.Unlock()
-	return appFs.Remove(filepath.Clean(file))
+
+	err = appFs.Remove(filepath.Clean(file))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	metrics.RecorderWrites.WithLabelValues(w.cluster).Inc()
+	return true, nil
 }
 
 func (w *Listener) relativePath(file string) string {
@@ -140,20 +240,35 @@ func (w *Listener) relativePath(file string) string {
 	return strings.Replace(file, filepath.Clean(root+"/"), "", 1)
 }
 
-func (w *Listener) save(file string, data []byte) error {
+func (w *Listener) save(file string, data []byte) (changed bool, err error) {
 	if w.dryRun {
-		return nil
+		return false, nil
 	}
 
-	csum := crc64.Checksum(data, crc64Table)
+	csum := Checksum(data)
 
 	w.activesLock.RLock()
 	prevsum, ok := w.actives[w.relativePath(file)]
 	w.activesLock.RUnlock()
 	if ok && prevsum == csum {
-		return nil
+		metrics.RecorderSkips.WithLabelValues(w.cluster).Inc()
+		return false, nil
 	}
 
+	if err = writeFile(file, data); err != nil {
+		return false, err
+	}
+
+	w.activesLock.Lock()
+	w.actives[w.relativePath(file)] = csum
+	w.activesLock.Unlock()
+
+	metrics.RecorderWrites.WithLabelValues(w.cluster).Inc()
+	return true, nil
+}
+
+// writeFile atomically replaces a file content
+func writeFile(file string, data []byte) error {
 	dir := filepath.Clean(filepath.Dir(file))
 
 	err := appFs.MkdirAll(dir, 0700)
@@ -179,14 +294,26 @@ func (w *Listener) save(file string, data []byte) error {
 		return fmt.Errorf("failed to rename %s to %s: %v", tmpf.Name(), file, err)
 	}
 
-	w.activesLock.Lock()
-	w.actives[w.relativePath(file)] = csum
-	w.activesLock.Unlock()
-
 	return nil
 }
 
+func isManifest(path string) bool {
+	for _, ext := range format.Extensions {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checksum returns the checksum the recorder uses to skip unchanged files
+func Checksum(data []byte) uint64 {
+	return crc64.Checksum(data, crc64Table)
+}
+
 func (w *Listener) deleteObsoleteFiles() {
+	w.deleteObsoleteDocuments()
+
 	w.activesLock.RLock()
 	defer w.activesLock.RUnlock()
 	root, err := filepath.Abs(w.localDir)
@@ -203,7 +330,8 @@ func (w *Listener) deleteObsoleteFiles() {
 			return nil
 		}
 
-		if !strings.HasSuffix(path, "yaml") {
+		// also collect files from previously used formats
+		if !isManifest(path) {
 			return nil
 		}
 
@@ -213,7 +341,11 @@ func (w *Listener) deleteObsoleteFiles() {
 		}
 
 		if !w.dryRun {
-			return appFs.Remove(filepath.Clean(path))
+			if err := appFs.Remove(filepath.Clean(path)); err != nil {
+				return err
+			}
+			metrics.RecorderGCDeletions.WithLabelValues(w.cluster).Inc()
+			w.touched(event.Delete, path, 0)
 		}
 
 		return nil
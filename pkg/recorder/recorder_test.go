@@ -4,9 +4,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/spf13/afero"
 
 	"github.com/bpineau/katafygio/pkg/event"
+	"github.com/bpineau/katafygio/pkg/format"
+	"github.com/bpineau/katafygio/pkg/metrics"
 )
 
 type mockLog struct{}
@@ -28,12 +31,17 @@ var (
 	fakedir = "/tmp/ktest"
 )
 
+func newLayout(output format.Format) *Layout {
+	layout, _ := NewLayout("", output, false)
+	return layout
+}
+
 func TestRecorder(t *testing.T) {
 	appFs = afero.NewMemMapFs()
 
 	evt := event.New()
 
-	rec := New(logs, evt, fakedir, 120, false).Start()
+	rec := New(logs, evt, nil, fakedir, newLayout(format.YAML), 120, false, "").Start()
 
 	evt.Send(newNotif(event.Upsert, "foo1"))
 	evt.Send(newNotif(event.Upsert, "foo2"))
@@ -68,11 +76,92 @@ func TestRecorder(t *testing.T) {
 	}
 }
 
+func TestHeldRecorder(t *testing.T) {
+	appFs = afero.NewMemMapFs()
+
+	evt := event.New()
+	changes := new(mockChangelog)
+	rec := New(logs, evt, changes, fakedir, newLayout(format.YAML), 120, false, "").Hold().Start()
+
+	evt.Send(newNotif(event.Upsert, "foo1"))
+	evt.Send(newNotif(event.Upsert, "foo2"))
+	evt.Send(newNotif(event.Delete, "foo1"))
+
+	exist, _ := afero.DirExists(appFs, fakedir)
+	if exist || len(changes.changes) > 0 {
+		t.Error("held recorders shouldn't touch the local directory")
+	}
+
+	if err := rec.Release(nil); err != nil {
+		t.Errorf("failed to release the recorder: %v", err)
+	}
+
+	evt.Send(newNotif(event.Upsert, "foo3"))
+	rec.Stop()
+
+	for file, expected := range map[string]bool{"foo-foo1.yaml": false, "foo-foo2.yaml": true, "foo-foo3.yaml": true} {
+		if exist, _ := afero.Exists(appFs, fakedir+"/"+file); exist != expected {
+			t.Errorf("%s should exist: %v", file, expected)
+		}
+	}
+}
+
+type mockChangelog struct {
+	changes []event.Notification
+}
+
+func (m *mockChangelog) Send(notif *event.Notification) {
+	m.changes = append(m.changes, *notif)
+}
+
+func TestRecorderChangelog(t *testing.T) {
+	appFs = afero.NewMemMapFs()
+
+	evt := event.New()
+	changes := new(mockChangelog)
+
+	rec := New(logs, evt, changes, fakedir, newLayout(format.YAML), 120, false, "").Start()
+
+	evt.Send(newNotif(event.Upsert, "foo1"))
+	evt.Send(newNotif(event.Upsert, "foo1")) // unchanged
+	evt.Send(newNotif(event.Delete, "foo1"))
+	evt.Send(newNotif(event.Delete, "foo1")) // already deleted
+	evt.Send(newNotif(event.Upsert, "foo1")) // re-created
+
+	rec.Stop()
+
+	if skips := testutil.ToFloat64(metrics.RecorderSkips.WithLabelValues("")); skips < 1 {
+		t.Errorf("unchanged files writes should be counted as skips (got %v)", skips)
+	}
+
+	if len(changes.changes) != 3 {
+		t.Fatalf("only effective changes should be notified (got %d)", len(changes.changes))
+	}
+
+	if changes.changes[1].Action != event.Delete || changes.changes[1].Key != "foo1" ||
+		changes.changes[1].Kind != "foo" {
+		t.Errorf("unexpected change notification: %+v", changes.changes[1])
+	}
+
+	if changes.changes[1].Path != fakedir+"/foo-foo1.yaml" {
+		t.Errorf("changes notifications should carry the touched file path, got %q", changes.changes[1].Path)
+	}
+
+	if changes.changes[0].Object != nil {
+		t.Error("changes notifications shouldn't retain objects content")
+	}
+
+	exist, _ := afero.Exists(appFs, fakedir+"/foo-foo1.yaml")
+	if !exist {
+		t.Error("foo-foo1.yaml should be re-created after a deletion")
+	}
+}
+
 func TestDryRunRecorder(t *testing.T) {
 	appFs = afero.NewMemMapFs()
 
 	dryevt := event.New()
-	dryrec := New(logs, dryevt, fakedir, 60, true).Start()
+	dryrec := New(logs, dryevt, nil, fakedir, newLayout(format.YAML), 60, true, "").Start()
 	dryevt.Send(newNotif(event.Upsert, "foo3"))
 	dryevt.Send(newNotif(event.Upsert, "foo4"))
 	dryevt.Send(newNotif(event.Delete, "foo4"))
@@ -99,20 +188,24 @@ func TestFailingFSRecorder(t *testing.T) {
 
 	evt := event.New()
 
-	rec := New(logs, evt, fakedir, 60, false).Start()
+	rec := New(logs, evt, nil, fakedir, newLayout(format.YAML), 60, false, "").Start()
 
 	_ = afero.WriteFile(appFs, fakedir+"/foo.yaml", []byte{42}, 0600)
 
 	// switching to failing (read-only) filesystem
 	appFs = afero.NewReadOnlyFs(appFs)
 
-	err := rec.save("foo", []byte("bar"))
+	_, err := rec.save("foo", []byte("bar"))
 	if err == nil {
 		t.Error("save should return an error in case of failure")
 	}
 
 	// shouldn't panic in case of failures
+	deletions := testutil.ToFloat64(metrics.RecorderGCDeletions.WithLabelValues(""))
 	rec.deleteObsoleteFiles()
+	if testutil.ToFloat64(metrics.RecorderGCDeletions.WithLabelValues("")) != deletions {
+		t.Error("failed garbage collections shouldn't be counted as deletions")
+	}
 
 	// shouldn't block (the controllers event loop will retry anyway)
 	ch := make(chan struct{})
@@ -142,3 +235,197 @@ func TestFailingFSRecorder(t *testing.T) {
 		t.Error("foo-foo2.yaml should exist; recorder should recover from fs failures")
 	}
 }
+
+func TestJSONRecorder(t *testing.T) {
+	appFs = afero.NewMemMapFs()
+
+	evt := event.New()
+	rec := New(logs, evt, nil, fakedir, newLayout(format.JSON), 120, false, "").Start()
+	evt.Send(newNotif(event.Upsert, "foo1"))
+	rec.Stop()
+
+	exist, _ := afero.Exists(appFs, fakedir+"/foo-foo1.json")
+	if !exist {
+		t.Error("foo-foo1.json should exist when using the json format")
+	}
+
+	// files from a previously used format should be garbage collected
+	previous := fakedir + "/foo-foo1.yaml"
+	_ = afero.WriteFile(appFs, previous, []byte{42}, 0600)
+	rec.deleteObsoleteFiles()
+
+	exist, _ = afero.Exists(appFs, previous)
+	if exist {
+		t.Errorf("%s file should have been garbage collected", previous)
+	}
+}
+
+func newDoc(action event.Action, kind, ns, name string) *event.Notification {
+	return &event.Notification{
+		Action: action,
+		Key:    ns + "/" + name,
+		Kind:   kind,
+		Object: []byte("kind: " + kind + "\nmetadata:\n  name: " + name + "\n  namespace: " + ns + "\n"),
+	}
+}
+
+func TestMultiDocRecorder(t *testing.T) {
+	appFs = afero.NewMemMapFs()
+
+	evt := event.New()
+	changes := new(mockChangelog)
+	rec := New(logs, evt, changes, fakedir, newLayout(format.MultiDoc), 120, false, "").Start()
+	evt.Send(newDoc(event.Upsert, "foo", "ns1", "b"))
+	evt.Send(newDoc(event.Upsert, "foo", "ns1", "a"))
+	evt.Send(newDoc(event.Upsert, "foo", "ns1", "c"))
+	evt.Send(newDoc(event.Delete, "foo", "ns1", "c"))
+	evt.Send(newDoc(event.Upsert, "bar", "ns2", "a"))
+	evt.Send(&event.Notification{Action: event.Upsert, Key: "ns2/a", Kind: "bar", Group: "example.com",
+		Object: []byte("apiVersion: example.com/v1\nkind: bar\nmetadata:\n  name: a\n  namespace: ns2\n")})
+	evt.Send(&event.Notification{Action: event.Upsert, Key: "a", Kind: "spam", Object: []byte("kind: spam\nmetadata:\n  name: a\n")})
+	rec.Stop()
+
+	if len(changes.changes) != 7 {
+		t.Errorf("all changes should be notified (got %d)", len(changes.changes))
+	}
+
+	expected := "---\nkind: foo\nmetadata:\n  name: a\n  namespace: ns1\n" +
+		"---\nkind: foo\nmetadata:\n  name: b\n  namespace: ns1\n"
+	data, _ := afero.ReadFile(appFs, fakedir+"/ns1.yaml")
+	if string(data) != expected {
+		t.Errorf("unexpected multi-document file content:\n%s", data)
+	}
+
+	for _, file := range []string{"ns2.yaml", format.ClusterFile + ".yaml"} {
+		if exist, _ := afero.Exists(appFs, fakedir+"/"+file); !exist {
+			t.Errorf("%s should exist", file)
+		}
+	}
+
+	data, _ = afero.ReadFile(appFs, fakedir+"/ns2.yaml")
+	if docs := splitDocuments(data); len(docs) != 2 {
+		t.Errorf("same kinds from distinct API groups shouldn't collide, got:\n%s", data)
+	}
+
+	// a new recorder should reuse existing files, and gc objects not seen since
+	evt = event.New()
+	changes = new(mockChangelog)
+	rec = New(logs, evt, changes, fakedir, newLayout(format.MultiDoc), 120, false, "").Start()
+	evt.Send(newDoc(event.Upsert, "foo", "ns1", "a"))
+	rec.Stop()
+
+	if len(changes.changes) != 0 {
+		t.Errorf("unchanged objects shouldn't be notified (got %d)", len(changes.changes))
+	}
+
+	rec.deleteObsoleteFiles()
+
+	expected = "---\nkind: foo\nmetadata:\n  name: a\n  namespace: ns1\n"
+	data, _ = afero.ReadFile(appFs, fakedir+"/ns1.yaml")
+	if string(data) != expected {
+		t.Errorf("stale objects should be garbage collected, got:\n%s", data)
+	}
+
+	if exist, _ := afero.Exists(appFs, fakedir+"/ns2.yaml"); exist {
+		t.Error("ns2.yaml should be garbage collected")
+	}
+
+	touched := make(map[string]event.Action)
+	for _, change := range changes.changes {
+		touched[change.Path] = change.Action
+	}
+	if touched[fakedir+"/ns1.yaml"] != event.Upsert || touched[fakedir+"/ns2.yaml"] != event.Delete {
+		t.Errorf("garbage collected files should be notified, got %v", touched)
+	}
+}
+
+type mockMover struct {
+	moves map[string]string
+}
+
+func (m *mockMover) Move(from, to string) error {
+	m.moves[from] = to
+	return appFs.Rename(from, to)
+}
+
+func TestLayout(t *testing.T) {
+	if _, err := NewLayout("{{.Namespace", format.YAML, false); err == nil {
+		t.Error("NewLayout should fail on invalid templates")
+	}
+
+	if _, err := NewLayout("{{.Foo}}", format.YAML, false); err == nil {
+		t.Error("NewLayout should fail on unknown fields")
+	}
+
+	layout, err := NewLayout("{{.Group}}/{{.Kind}}/{{.Namespace}}/{{.Name}}.yaml", format.JSON, false)
+	if err != nil {
+		t.Fatalf("failed to create a layout: %v", err)
+	}
+
+	ev := &event.Notification{Kind: "deployment", Group: "apps", Version: "v1", Key: "ns1/foo"}
+	if path := layout.Path(notifPath(ev)); path != "apps/deployment/ns1/foo.json" {
+		t.Errorf("unexpected path %s", path)
+	}
+
+	if path := layout.Path(PathData{Version: "v1", Kind: "namespace", Name: "ns1"}); path != "namespace/_cluster/ns1.json" {
+		t.Errorf("cluster scoped objects should go in the _cluster directory, got %s", path)
+	}
+
+	qualified, _ := NewLayout("{{.Namespace}}/{{.QualifiedKind}}/{{.Name}}", format.YAML, false)
+	if path := qualified.Path(notifPath(ev)); path != "ns1/deployment.apps/foo.yaml" {
+		t.Errorf("templates should be able to qualify kinds by their API group, got %s", path)
+	}
+	if path := qualified.Path(PathData{Version: "v1", Kind: "configmap", Namespace: "ns1", Name: "foo"}); path != "ns1/configmap/foo.yaml" {
+		t.Errorf("core kinds shouldn't be qualified, got %s", path)
+	}
+
+	if path := layout.Path(PathData{Kind: "foo", Namespace: "..", Name: "../../bar"}); path != "bar.json" {
+		t.Errorf("paths shouldn't escape the local directory, got %s", path)
+	}
+
+	def := newLayout(format.YAML)
+	if path := def.Path(PathData{Kind: "foo", Name: "bar"}); path != "foo-bar.yaml" {
+		t.Errorf("cluster scoped objects should be at the root without layout template, got %s", path)
+	}
+
+	if path := def.Path(PathData{Group: "cert-manager.io", Kind: "certificate", Namespace: "ns1", Name: "bar"}); path != "ns1/certificate.cert-manager.io-bar.yaml" {
+		t.Errorf("files names should be qualified by the objects API group, got %s", path)
+	}
+
+	legacy, _ := NewLayout("", format.YAML, true)
+	if path := legacy.Path(PathData{Group: "apps", Kind: "deployment", Namespace: "ns1", Name: "bar"}); path != "ns1/deployment-bar.yaml" {
+		t.Errorf("legacy files names shouldn't be qualified by API group, got %s", path)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	appFs = afero.NewMemMapFs()
+
+	deploy := "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: foo\n  namespace: ns1\n"
+	_ = afero.WriteFile(appFs, fakedir+"/ns1/deployment-foo.yaml", []byte(deploy), 0600)
+	_ = afero.WriteFile(appFs, fakedir+"/namespace-ns1.yaml", []byte("apiVersion: v1\nkind: Namespace\nmetadata:\n  name: ns1\n"), 0600)
+	_ = afero.WriteFile(appFs, fakedir+"/.git/foo.yaml", []byte("apiVersion: v1\nkind: Foo\nmetadata:\n  name: foo\n"), 0600)
+
+	layout, _ := NewLayout("{{.Namespace}}/{{.Kind}}/{{.Name}}", format.YAML, false)
+	rec := New(logs, event.New(), nil, fakedir, layout, 120, false, "")
+
+	mv := &mockMover{moves: make(map[string]string)}
+	if err := rec.Migrate(mv); err != nil {
+		t.Fatalf("migration failed: %v", err)
+	}
+
+	if len(mv.moves) != 2 {
+		t.Errorf("expected 2 moves, got %v", mv.moves)
+	}
+
+	data, _ := afero.ReadFile(appFs, fakedir+"/ns1/deployment/foo.yaml")
+	if string(data) != deploy {
+		t.Error("files should be moved according to the layout")
+	}
+
+	for _, file := range []string{"/_cluster/namespace/ns1.yaml", "/.git/foo.yaml"} {
+		if exist, _ := afero.Exists(appFs, fakedir+file); !exist {
+			t.Errorf("%s should exist", file)
+		}
+	}
+}
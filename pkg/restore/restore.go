@@ -0,0 +1,303 @@
+// Package restore reads a dump directory (as produced by the recorder), and
+// re-applies its objects to a cluster using server-side apply. Objects are
+// applied by dependency order: CRDs and namespaces first, then RBAC, then
+// configurations and storage, and finally workloads and everything else.
+// Owner references are removed, as they refer to the dumped objects uids.
+package restore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+)
+
+var (
+	appFs = afero.NewOsFs()
+
+	// FieldManager is the server-side apply field manager name
+	FieldManager = "katafygio"
+
+	// MappingTimeout is how long we wait for a kind to be known by the
+	// api-server (ie. for a freshly restored CRD to be established)
+	MappingTimeout = 30 * time.Second
+
+	mappingInterval = time.Second
+)
+
+// objects kinds, by restore priority; unlisted kinds are restored last
+var kindsOrder = [][]string{
+	{"CustomResourceDefinition", "Namespace"},
+	{"ServiceAccount", "ClusterRole", "ClusterRoleBinding", "Role", "RoleBinding"},
+	{"ConfigMap", "Secret", "PriorityClass", "StorageClass", "PersistentVolume",
+		"PersistentVolumeClaim", "LimitRange", "ResourceQuota"},
+}
+
+type restclient interface {
+	GetRestConfig() *rest.Config
+}
+
+type logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type decrypter interface {
+	Decrypt(obj *unstructured.Unstructured) error
+}
+
+type resettableMapper interface {
+	meta.RESTMapper
+	Reset()
+}
+
+// Restorer applies dumped objects to a cluster
+type Restorer struct {
+	logger    logger
+	client    dynamic.Interface
+	mapper    resettableMapper
+	decrypter decrypter
+	excluded  []string
+	dryRun    bool
+	force     bool
+}
+
+// New returns a Restorer. Encrypted objects are decrypted with dec. In dryRun
+// mode, objects are submitted to the api-server for validation but not
+// persisted. force resolves server-side apply conflicts by taking fields ownership.
+func New(log logger, client restclient, excluded []string, dec decrypter, dryRun, force bool) *Restorer {
+	dc := discovery.NewDiscoveryClientForConfigOrDie(client.GetRestConfig())
+	return &Restorer{
+		logger:    log,
+		client:    dynamic.NewForConfigOrDie(client.GetRestConfig()),
+		mapper:    restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(dc)),
+		decrypter: dec,
+		excluded:  excluded,
+		dryRun:    dryRun,
+		force:     force,
+	}
+}
+
+// Restore loads all objects from a dump directory and applies them in order
+func (r *Restorer) Restore(dir string) error {
+	objs, err := Load(dir)
+	if err != nil {
+		return err
+	}
+
+	failures := 0
+	for _, obj := range objs {
+		if r.isExcluded(obj) {
+			continue
+		}
+
+		if err := r.apply(obj); err != nil {
+			r.logger.Errorf("failed to restore %s %s: %v", obj.GetKind(), objKey(obj), err)
+			failures++
+			continue
+		}
+
+		r.logger.Infof("Restored %s %s", obj.GetKind(), objKey(obj))
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("failed to restore %d out of %d objects", failures, len(objs))
+	}
+
+	return nil
+}
+
+// Load reads all dumped objects from a directory, sorted by restore order
+func Load(dir string) ([]*unstructured.Unstructured, error) {
+	var objs []*unstructured.Unstructured
+
+	root := filepath.Clean(dir)
+	err := afero.Walk(appFs, root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if strings.HasPrefix(info.Name(), ".") || !isManifest(path) {
+			return nil
+		}
+
+		fobjs, err := loadFile(path)
+		if err != nil {
+			return err
+		}
+
+		objs = append(objs, fobjs...)
+		return nil
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to load objects from %s: %v", dir, err)
+	}
+
+	sortObjects(objs)
+
+	return objs, nil
+}
+
+func isManifest(path string) bool {
+	for _, ext := range []string{".yaml", ".yml", ".json"} {
+		if strings.HasSuffix(path, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func loadFile(path string) ([]*unstructured.Unstructured, error) {
+	data, err := afero.ReadFile(appFs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var objs []*unstructured.Unstructured
+	decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096)
+	for {
+		content := make(map[string]interface{})
+		err := decoder.Decode(&content)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %v", path, err)
+		}
+
+		if len(content) == 0 {
+			continue
+		}
+
+		obj := &unstructured.Unstructured{Object: content}
+		if obj.GetKind() == "" || obj.GetName() == "" {
+			return nil, fmt.Errorf("%s doesn't contain a valid kubernetes object", path)
+		}
+
+		objs = append(objs, obj)
+	}
+
+	return objs, nil
+}
+
+func kindPriority(kind string) int {
+	for prio, kinds := range kindsOrder {
+		for _, k := range kinds {
+			if k == kind {
+				return prio
+			}
+		}
+	}
+	return len(kindsOrder)
+}
+
+func sortObjects(objs []*unstructured.Unstructured) {
+	sort.SliceStable(objs, func(i, j int) bool {
+		pi, pj := kindPriority(objs[i].GetKind()), kindPriority(objs[j].GetKind())
+		if pi != pj {
+			return pi < pj
+		}
+		if objs[i].GetKind() != objs[j].GetKind() {
+			return objs[i].GetKind() < objs[j].GetKind()
+		}
+		return objKey(objs[i]) < objKey(objs[j])
+	})
+}
+
+func objKey(obj *unstructured.Unstructured) string {
+	if obj.GetNamespace() == "" {
+		return obj.GetName()
+	}
+	return obj.GetNamespace() + "/" + obj.GetName()
+}
+
+func (r *Restorer) isExcluded(obj *unstructured.Unstructured) bool {
+	kind := strings.ToLower(obj.GetKind())
+	for _, excl := range r.excluded {
+		if strings.Compare(kind, strings.ToLower(excl)) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// restMapping finds the resource serving an object kind. Kinds provided by
+// CRDs we just restored may take some time to show up in discovery.
+func (r *Restorer) restMapping(obj *unstructured.Unstructured) (*meta.RESTMapping, error) {
+	gvk := obj.GroupVersionKind()
+
+	deadline := time.Now().Add(MappingTimeout)
+	for {
+		mapping, err := r.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err == nil {
+			return mapping, nil
+		}
+
+		if !meta.IsNoMatchError(err) || time.Now().After(deadline) {
+			return nil, fmt.Errorf("can't find a resource serving %s: %v", gvk.String(), err)
+		}
+
+		r.mapper.Reset()
+		time.Sleep(mappingInterval)
+	}
+}
+
+func (r *Restorer) apply(obj *unstructured.Unstructured) error {
+	mapping, err := r.restMapping(obj)
+	if err != nil {
+		return err
+	}
+
+	if r.decrypter != nil {
+		if err = r.decrypter.Decrypt(obj); err != nil {
+			return err
+		}
+	}
+
+	// owners' uids are those of the dumped cluster: the garbage collector
+	// would delete objects referencing owners it can't find
+	obj.SetOwnerReferences(nil)
+
+	data, err := obj.MarshalJSON()
+	if err != nil {
+		return fmt.Errorf("failed to marshal: %v", err)
+	}
+
+	opts := metav1.PatchOptions{FieldManager: FieldManager, Force: &r.force}
+	if r.dryRun {
+		opts.DryRun = []string{metav1.DryRunAll}
+	}
+
+	var client dynamic.ResourceInterface = r.client.Resource(mapping.Resource)
+	if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+		client = r.client.Resource(mapping.Resource).Namespace(obj.GetNamespace())
+	}
+
+	_, err = client.Patch(obj.GetName(), types.ApplyPatchType, data, opts)
+	return err
+}
@@ -0,0 +1,217 @@
+package restore
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+type mockLog struct{}
+
+func (m *mockLog) Infof(format string, args ...interface{})  {}
+func (m *mockLog) Errorf(format string, args ...interface{}) {}
+
+type mockMapper struct {
+	*meta.DefaultRESTMapper
+	resets int
+}
+
+func (m *mockMapper) Reset() {
+	m.resets++
+}
+
+type mockDecrypter struct {
+	count int
+}
+
+func (m *mockDecrypter) Decrypt(obj *unstructured.Unstructured) error {
+	m.count++
+	return nil
+}
+
+var fakedir = "/tmp/ktest"
+
+var dump = map[string]string{
+	"/deployment-api.yaml": `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+  namespace: default
+  ownerReferences:
+  - apiVersion: example.com/v1
+    kind: Foo
+    name: api
+    uid: 0b9c6e4e-4a4c-4fb8-9f5a-3e1b7e2f8d11
+`,
+	"/namespace-default.yaml": `
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: default
+`,
+	"/default/configmap-foo.yaml": `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+  namespace: default
+data:
+  spam: egg
+`,
+	"/default/rolebinding-bar.yaml": `
+apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: bar
+  namespace: default
+`,
+	"/customresourcedefinition-foos.example.com.yaml": `
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: foos.example.com
+`,
+	"/default/secret-baz.json": `{"apiVersion": "v1", "kind": "Secret", "metadata": {"name": "baz", "namespace": "default"}}`,
+	"/default/multi.yaml": `
+apiVersion: v1
+kind: Service
+metadata:
+  name: svc1
+  namespace: default
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: svc2
+  namespace: default
+`,
+	"/.git/config":            "not a manifest",
+	"/default/README.txt":     "not a manifest",
+	"/default/.temp-katafygi": "not a manifest",
+}
+
+func writeDump(t *testing.T) {
+	appFs = afero.NewMemMapFs()
+	for path, content := range dump {
+		if err := afero.WriteFile(appFs, fakedir+path, []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write %s: %v", path, err)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	writeDump(t)
+
+	objs, err := Load(fakedir)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	var got []string
+	for _, obj := range objs {
+		got = append(got, obj.GetKind()+":"+objKey(obj))
+	}
+
+	expected := []string{
+		"CustomResourceDefinition:foos.example.com",
+		"Namespace:default",
+		"RoleBinding:default/bar",
+		"ConfigMap:default/foo",
+		"Secret:default/baz",
+		"Deployment:default/api",
+		"Service:default/svc1",
+		"Service:default/svc2",
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected objects or order: expected %v actual %v", expected, got)
+	}
+
+	_ = afero.WriteFile(appFs, fakedir+"/broken.yaml", []byte("kind: Foo\n"), 0600)
+	if _, err = Load(fakedir); err == nil {
+		t.Error("Load should fail on invalid objects")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	writeDump(t)
+	MappingTimeout = 20 * time.Millisecond
+	mappingInterval = 5 * time.Millisecond
+
+	mapper := &mockMapper{DefaultRESTMapper: meta.NewDefaultRESTMapper(nil)}
+	for _, gvk := range []schema.GroupVersionKind{
+		{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"},
+		{Group: "", Version: "v1", Kind: "Namespace"},
+	} {
+		mapper.Add(gvk, meta.RESTScopeRoot)
+	}
+	for _, gvk := range []schema.GroupVersionKind{
+		{Group: "rbac.authorization.k8s.io", Version: "v1", Kind: "RoleBinding"},
+		{Group: "", Version: "v1", Kind: "ConfigMap"},
+		{Group: "", Version: "v1", Kind: "Secret"},
+		{Group: "apps", Version: "v1", Kind: "Deployment"},
+	} {
+		mapper.Add(gvk, meta.RESTScopeNamespace)
+	}
+
+	client := fakedynamic.NewSimpleDynamicClient(runtime.NewScheme())
+	var applied []string
+	client.PrependReactor("patch", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		if patch.GetPatchType() != types.ApplyPatchType {
+			return true, nil, fmt.Errorf("unexpected patch type %s", patch.GetPatchType())
+		}
+		if strings.Contains(string(patch.GetPatch()), "ownerReferences") {
+			return true, nil, fmt.Errorf("owner references should be removed")
+		}
+		applied = append(applied, patch.GetResource().Resource+":"+patch.GetNamespace()+"/"+patch.GetName())
+		return true, nil, nil
+	})
+
+	dec := new(mockDecrypter)
+	r := &Restorer{
+		logger:    new(mockLog),
+		client:    client,
+		mapper:    mapper,
+		decrypter: dec,
+		excluded:  []string{"configmap"},
+	}
+
+	err := r.Restore(fakedir)
+	if err == nil {
+		t.Error("Restore should report objects it can't map (services)")
+	}
+
+	expected := []string{
+		"customresourcedefinitions:/foos.example.com",
+		"namespaces:/default",
+		"rolebindings:default/bar",
+		"secrets:default/baz",
+		"deployments:default/api",
+	}
+
+	if !reflect.DeepEqual(applied, expected) {
+		t.Errorf("unexpected restore: expected %v actual %v", expected, applied)
+	}
+
+	if dec.count != len(expected) {
+		t.Errorf("all restored objects should go through the decrypter")
+	}
+
+	if mapper.resets == 0 {
+		t.Error("unknown kinds should trigger a discovery refresh")
+	}
+}
@@ -0,0 +1,64 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	from := time.Date(2021, time.January, 30, 10, 17, 42, 0, time.UTC) // a saturday
+
+	tests := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2021, time.January, 30, 10, 18, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2021, time.January, 30, 11, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2021, time.January, 30, 10, 30, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2021, time.January, 30, 10, 25, 0, 0, time.UTC)},
+		{"@daily", time.Date(2021, time.January, 31, 0, 0, 0, 0, time.UTC)},
+		{"30 2 * * 1-5", time.Date(2021, time.February, 1, 2, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2021, time.January, 31, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2021, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 31 2,4,5 *", time.Date(2021, time.May, 31, 12, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2021, time.February, 5, 0, 0, 0, 0, time.UTC)}, // day of month or week
+		{"0 0 1 * */2", time.Date(2021, time.April, 1, 0, 0, 0, 0, time.UTC)},   // day of month and week
+		{"0 0 */2 * 1", time.Date(2021, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 8,20 * 1,6 *", time.Date(2021, time.January, 30, 20, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+
+	for _, tt := range tests {
+		sched, err := Parse(tt.expr)
+		if err != nil {
+			t.Errorf("failed to parse %q: %v", tt.expr, err)
+			continue
+		}
+
+		if next := sched.Next(from); !next.Equal(tt.next) {
+			t.Errorf("%q should fire at %v, got %v", tt.expr, tt.next, next)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"@often",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("%q should fail to parse", expr)
+		}
+	}
+}
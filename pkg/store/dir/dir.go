@@ -0,0 +1,41 @@
+// Package dir is a storage backend keeping the objects dumped in the local
+// directory as they are: unversioned, and not copied elsewhere.
+package dir
+
+type logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Store is a no-op storage backend
+type Store struct {
+	Logger   logger
+	LocalDir string
+}
+
+// New instantiate a new dir Store
+func New(log logger, dir string) *Store {
+	return &Store{
+		Logger:   log,
+		LocalDir: dir,
+	}
+}
+
+// Start starts the (no-op) synchronizer
+func (s *Store) Start() (*Store, error) {
+	s.Logger.Infof("Keeping objects unversioned in %s", s.LocalDir)
+	return s, nil
+}
+
+// Stop stops the (no-op) synchronizer
+func (s *Store) Stop() {}
+
+// Commit is a no-op: the local directory is the storage
+func (s *Store) Commit() (changed bool, err error) {
+	return false, nil
+}
+
+// Push is a no-op: there's no remote storage
+func (s *Store) Push() error {
+	return nil
+}
@@ -0,0 +1,32 @@
+package dir
+
+import (
+	"testing"
+
+	"github.com/bpineau/katafygio/pkg/store"
+)
+
+type mockLog struct{}
+
+func (m *mockLog) Infof(format string, args ...interface{})  {}
+func (m *mockLog) Errorf(format string, args ...interface{}) {}
+
+func TestDir(t *testing.T) {
+	var repo store.Backend
+
+	repo, err := New(new(mockLog), "/tmp/ktest").Start()
+	if err != nil {
+		t.Errorf("failed to start dir store: %v", err)
+	}
+
+	changed, err := repo.Commit()
+	if changed || err != nil {
+		t.Errorf("Commit should be a no-op (%v)", err)
+	}
+
+	if err = repo.Push(); err != nil {
+		t.Errorf("Push should be a no-op (%v)", err)
+	}
+
+	repo.Stop()
+}
@@ -0,0 +1,197 @@
+package git
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// askpassScript answers git (https) and ssh credentials prompts from the
+// environment, so secrets never appear in commands arguments. ssh-keygen's
+// signing prompt ("Enter passphrase:", or naming the signing key) gets the
+// signing key passphrase, as the same command may also fetch from the remote.
+const askpassScript = `#!/bin/sh
+case "$1" in
+Username*) printf '%s\n' "$KATAFYGIO_GIT_USERNAME"; exit 0 ;;
+"Enter passphrase:"*) printf '%s\n' "$KATAFYGIO_SIGNING_PASSPHRASE"; exit 0 ;;
+esac
+if [ -n "$KATAFYGIO_SIGNING_KEY" ]; then
+	case "$1" in
+	*"$KATAFYGIO_SIGNING_KEY"*) printf '%s\n' "$KATAFYGIO_SIGNING_PASSPHRASE"; exit 0 ;;
+	esac
+fi
+printf '%s\n' "$KATAFYGIO_GIT_PASSWORD"
+`
+
+// protocol returns the remote repository url scheme, ie. "ssh" or "https"
+func (s *Store) protocol() string {
+	ep, err := transport.NewEndpoint(s.URL)
+	if err != nil {
+		return ""
+	}
+	return ep.Protocol
+}
+
+// password returns the secret expected by the remote repository protocol
+func (s *Store) password() string {
+	if s.protocol() == "ssh" {
+		return s.SSHPassphrase
+	}
+	return s.Token
+}
+
+// setupAuth writes the askpass helper used by the exec driver, when needed
+func (s *Store) setupAuth() error {
+	needed := s.URL != "" && s.password() != "" ||
+		s.signer != nil && s.signer.format == SigningSSH && s.SigningPassphrase != ""
+	if s.Driver != DriverExec || s.askpass != "" || !needed {
+		return nil
+	}
+
+	// on the actual filesystem, as run by git and ssh
+	f, err := ioutil.TempFile("", "katafygio-askpass-")
+	if err != nil {
+		return fmt.Errorf("failed to create an askpass helper: %v", err)
+	}
+	defer f.Close()
+
+	if _, err = f.WriteString(askpassScript); err != nil {
+		return fmt.Errorf("failed to write the askpass helper: %v", err)
+	}
+
+	if err = f.Chmod(0700); err != nil {
+		return fmt.Errorf("failed to chmod the askpass helper: %v", err)
+	}
+
+	s.askpass = f.Name()
+	return nil
+}
+
+// cleanupAuth removes the askpass helper
+func (s *Store) cleanupAuth() {
+	if s.askpass != "" {
+		_ = os.Remove(s.askpass)
+		s.askpass = ""
+	}
+}
+
+// authEnv returns the environment variables passing the credentials and ssh
+// settings to the git command
+func (s *Store) authEnv() []string {
+	var env []string
+
+	if s.SSHKeyFile != "" || s.KnownHostsFile != "" || !s.StrictHostKey {
+		env = append(env, "GIT_SSH_COMMAND="+s.sshCommand())
+	}
+
+	if s.askpass == "" {
+		return env
+	}
+
+	env = append(env,
+		"GIT_ASKPASS="+s.askpass,
+		"GIT_TERMINAL_PROMPT=0",
+		"SSH_ASKPASS="+s.askpass,
+		"SSH_ASKPASS_REQUIRE=force",
+		"KATAFYGIO_GIT_USERNAME="+s.Username,
+		"KATAFYGIO_GIT_PASSWORD="+s.password(),
+	)
+
+	// ssh versions predating SSH_ASKPASS_REQUIRE only use askpass with a display
+	if os.Getenv("DISPLAY") == "" {
+		env = append(env, "DISPLAY=:0")
+	}
+
+	return env
+}
+
+func (s *Store) sshCommand() string {
+	args := []string{"ssh"}
+	if s.SSHKeyFile != "" {
+		args = append(args, "-i", shellQuote(s.SSHKeyFile), "-o", "IdentitiesOnly=yes")
+	}
+
+	if s.KnownHostsFile != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+shellQuote(s.KnownHostsFile))
+	} else if !s.StrictHostKey {
+		args = append(args, "-o", "UserKnownHostsFile=/dev/null")
+	}
+
+	if s.StrictHostKey {
+		args = append(args, "-o", "StrictHostKeyChecking=yes")
+	} else {
+		args = append(args, "-o", "StrictHostKeyChecking=no")
+	}
+
+	return strings.Join(args, " ")
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// authMethod returns the native driver's credentials for the remote repository
+func (s *Store) authMethod() (transport.AuthMethod, error) {
+	ep, err := transport.NewEndpoint(s.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch ep.Protocol {
+	case "ssh":
+		if s.SSHKeyFile == "" && s.KnownHostsFile == "" && s.StrictHostKey {
+			return nil, nil // go-git defaults: ssh agent, and user's known_hosts
+		}
+
+		user := ep.User
+		if user == "" {
+			user = "git"
+		}
+
+		var auth transport.AuthMethod
+		var hostKeys *gitssh.HostKeyCallbackHelper
+		if s.SSHKeyFile != "" {
+			keys, err := gitssh.NewPublicKeysFromFile(user, s.SSHKeyFile, s.SSHPassphrase)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load ssh key %s: %v", s.SSHKeyFile, err)
+			}
+			auth, hostKeys = keys, &keys.HostKeyCallbackHelper
+		} else {
+			agent, err := gitssh.NewSSHAgentAuth(user)
+			if err != nil {
+				return nil, err
+			}
+			auth, hostKeys = agent, &agent.HostKeyCallbackHelper
+		}
+
+		if !s.StrictHostKey {
+			hostKeys.HostKeyCallback = gossh.InsecureIgnoreHostKey() // #nosec
+			return auth, nil
+		}
+
+		var files []string
+		if s.KnownHostsFile != "" {
+			files = append(files, s.KnownHostsFile)
+		}
+		hostKeys.HostKeyCallback, err = gitssh.NewKnownHostsCallback(files...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load known hosts: %v", err)
+		}
+
+		return auth, nil
+
+	case "http", "https":
+		if s.Token == "" {
+			return nil, nil // credentials from the url, if any
+		}
+		return &githttp.BasicAuth{Username: s.Username, Password: s.Token}, nil
+	}
+
+	return nil, nil
+}
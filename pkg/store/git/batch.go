@@ -0,0 +1,152 @@
+package git
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bpineau/katafygio/pkg/event"
+)
+
+// batch tracks the changes notified since the last commit, and the recent
+// commits, to apply the commit policies
+type batch struct {
+	sync.Mutex
+	first   time.Time       // first change notified since the last commit
+	last    time.Time       // latest change notified
+	scanned time.Time       // latest full status scan
+	commits []time.Time     // commits made during the last hour
+	paths   map[string]bool // notified paths, relative to the local directory
+	full    bool            // the next commit must stage the whole directory
+	changes []event.Notification
+}
+
+// notified records a change to the local directory, to be committed, and
+// the paths it touched (absolute, or relative to the local directory). The
+// object change, if any, is kept for the commit message.
+func (s *Store) notified(now time.Time, change *event.Notification, paths ...string) {
+	s.batch.Lock()
+	defer s.batch.Unlock()
+
+	if s.batch.first.IsZero() {
+		s.batch.first = now
+	}
+	s.batch.last = now
+
+	if change != nil {
+		s.batch.changes = append(s.batch.changes, *change)
+	}
+
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		rel, err := s.relative(path)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		if s.batch.paths == nil {
+			s.batch.paths = make(map[string]bool)
+		}
+		s.batch.paths[filepath.ToSlash(rel)] = true
+	}
+}
+
+// flush returns and forgets the notified paths and changes, at once (so they
+// describe the same files), and tells if the whole directory must be staged
+func (s *Store) flush() (paths []string, full bool, changes []event.Notification) {
+	s.batch.Lock()
+	defer s.batch.Unlock()
+
+	paths = make([]string, 0, len(s.batch.paths))
+	for path := range s.batch.paths {
+		paths = append(paths, path)
+	}
+	full = s.batch.full || len(paths) == 0
+	changes = s.batch.changes
+	s.batch.paths = nil
+	s.batch.full = false
+	s.batch.changes = nil
+
+	return paths, full, changes
+}
+
+// restore re-queues the paths and changes that failed to be committed
+func (s *Store) restore(paths []string, full bool, changes []event.Notification) {
+	s.batch.Lock()
+	defer s.batch.Unlock()
+
+	if s.batch.paths == nil {
+		s.batch.paths = make(map[string]bool)
+	}
+	for _, path := range paths {
+		s.batch.paths[path] = true
+	}
+	s.batch.full = s.batch.full || full
+	s.batch.changes = append(changes, s.batch.changes...)
+}
+
+// rescan makes the next commit stage the whole directory, ie. once the index
+// was reset to a commit the notified paths don't tell the differences with
+func (s *Store) rescan() {
+	s.batch.Lock()
+	defer s.batch.Unlock()
+	s.batch.full = true
+}
+
+// commitDue tells if the pending changes should be committed now: once no
+// change was notified for QuietPeriod, or when the oldest pending change waited
+// for MaxBatchWindow, provided we didn't commit MaxCommitsPerHour times during
+// the last hour. Without notified changes, a full status scan is only due at
+// start, once requested (see rescan), or every FullCheckInterval when set.
+func (s *Store) commitDue(now time.Time) bool {
+	s.batch.Lock()
+	defer s.batch.Unlock()
+
+	if s.MaxCommitsPerHour > 0 {
+		recent := s.batch.commits[:0]
+		for _, at := range s.batch.commits {
+			if now.Sub(at) < time.Hour {
+				recent = append(recent, at)
+			}
+		}
+		s.batch.commits = recent
+
+		if len(recent) >= s.MaxCommitsPerHour {
+			return false
+		}
+	}
+
+	if s.batch.first.IsZero() {
+		return s.batch.full || s.batch.scanned.IsZero() ||
+			(s.FullCheckInterval > 0 && now.Sub(s.batch.scanned) >= s.FullCheckInterval)
+	}
+
+	if s.MaxBatchWindow > 0 && now.Sub(s.batch.first) >= s.MaxBatchWindow {
+		return true
+	}
+
+	return now.Sub(s.batch.last) >= s.QuietPeriod
+}
+
+// committed resets the batch after a successful commit (or full status scan,
+// when full is set) started at start. Changes notified meanwhile remain pending.
+func (s *Store) committed(start time.Time, changed, full bool) {
+	s.batch.Lock()
+	defer s.batch.Unlock()
+
+	if s.batch.last.Before(start) {
+		s.batch.first = time.Time{}
+		s.batch.last = time.Time{}
+	} else {
+		s.batch.first = start
+	}
+
+	if full {
+		s.batch.scanned = start
+	}
+	if changed {
+		s.batch.commits = append(s.batch.commits, start)
+	}
+}
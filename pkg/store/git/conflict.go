@@ -0,0 +1,118 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bpineau/katafygio/pkg/metrics"
+)
+
+const (
+	// ConflictMerge merges the remote branch, favoring local content on
+	// conflicts (the local dump reflects the cluster's current state)
+	ConflictMerge = "merge"
+
+	// ConflictRebase rebases the local commits on the remote branch
+	// (requires the exec driver)
+	ConflictRebase = "rebase"
+
+	// ConflictReset drops the local commits, and commits the current dump on
+	// top of the remote branch
+	ConflictReset = "reset"
+
+	// ConflictSideBranch leaves the remote branch alone, and pushes the local
+	// commits to a side branch (ConflictBranch) for a human to reconcile
+	ConflictSideBranch = "side-branch"
+)
+
+// ErrDiverged is returned when the local and remote histories diverged, and
+// weren't reconciled (ie. with the side-branch strategy)
+var ErrDiverged = errors.New("local and remote histories diverged")
+
+func (s *Store) checkConflictStrategy() error {
+	switch s.ConflictStrategy {
+	case ConflictMerge, ConflictReset, ConflictSideBranch:
+		return nil
+	case ConflictRebase:
+		if s.Driver != DriverExec {
+			return fmt.Errorf("the %s conflict strategy requires the %s git driver", ConflictRebase, DriverExec)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown conflict strategy %q", s.ConflictStrategy)
+}
+
+// conflictBranch returns the side branch receiving diverged local commits
+func (s *Store) conflictBranch(branch string) string {
+	if s.ConflictBranch != "" {
+		return s.ConflictBranch
+	}
+	return "katafygio/diverged/" + branch
+}
+
+// Reconcile fetches the remote branch and, when the remote has commits we
+// don't have, integrates them according to the ConflictStrategy. A failed
+// or deferred (side-branch) reconciliation marks the repository as
+// conflicted, which makes the store unready until histories converge again.
+func (s *Store) Reconcile() error {
+	if s.DryRun || s.URL == "" {
+		return nil
+	}
+
+	ahead, behind, branch, err := s.driver().diverged()
+	if err != nil {
+		metrics.GitFailures.WithLabelValues("pull").Inc()
+		return fmt.Errorf("failed to fetch the remote branch: %w", err)
+	}
+
+	if !behind {
+		s.setConflicted(nil)
+		return nil
+	}
+
+	switch {
+	case !ahead || s.ConflictStrategy == ConflictMerge:
+		err = s.driver().pull()
+	case s.ConflictStrategy == ConflictRebase:
+		err = s.driver().rebase()
+	case s.ConflictStrategy == ConflictReset:
+		err = s.driver().reset()
+		if err == nil {
+			// the dropped commits' changes are back in the worktree only
+			s.rescan()
+		}
+	case s.ConflictStrategy == ConflictSideBranch:
+		side := s.conflictBranch(branch)
+		err = s.driver().pushTo(side)
+		if err == nil {
+			err = fmt.Errorf("%w: local commits pushed to %s", ErrDiverged, side)
+		}
+	}
+
+	if err != nil {
+		metrics.GitFailures.WithLabelValues("pull").Inc()
+		s.setConflicted(err)
+		return fmt.Errorf("failed to reconcile with the remote branch: %w", err)
+	}
+
+	s.setConflicted(nil)
+	return nil
+}
+
+func (s *Store) setConflicted(err error) {
+	if err != nil {
+		metrics.GitConflicted.Set(1)
+	} else {
+		metrics.GitConflicted.Set(0)
+	}
+	s.reportResult("conflict", err)
+}
+
+// Conflicted tells if the last reconciliation with the remote branch failed
+func (s *Store) Conflicted() bool {
+	s.health.Lock()
+	defer s.health.Unlock()
+	_, ok := s.health.lastErr["conflict"]
+	return ok
+}
@@ -2,6 +2,30 @@
 // content committed when the directory content changes, and optionaly (if
 // a remote repos url is provided), keep it in sync with a remote repository.
 //
-// It requires the git command in $PATH, since the pure Go git implementations
-// aren't up to the task (see go-git issues #793 and #785 for instance).
+// Commit messages list the objects changed since the previous commit, as
+// notified (through Send) by the recorder. Only the files paths it notified are
+// staged, so the local directory's full status is only scanned at start, after
+// a reset reconciliation, and every FullCheckInterval when set (catching
+// changes made behind our back).
+//
+// By default it runs the git command (which must be in $PATH). A native driver,
+// based on go-git, is also available for environments lacking a git binary;
+// it doesn't support the rebase conflict strategy, and merges file by file
+// (local content wins on files changed on both sides).
+//
+// When a Branch is set, it is checked out (or created from the cloned branch),
+// and pulled from and pushed to the remote repository.
+//
+// Before pushing, the remote branch is fetched and, when histories diverged,
+// reconciled according to the ConflictStrategy (merge, rebase, reset, or push
+// local commits to a side branch). Until reconciled, the store is unready.
+//
+// Commits may be batched by commit policies (QuietPeriod, MaxBatchWindow and
+// MaxCommitsPerHour), driven by the changes notifications.
+//
+// Snapshot tags are created on a SnapshotSchedule, and pruned according to a
+// retention policy (SnapshotKeepHourly, SnapshotKeepDaily, SnapshotKeepMonthly).
+//
+// Commits are signed when a SigningKey is provided (GPG, or SSH with the exec
+// driver); they fail rather than being left unsigned when signing fails.
 package git
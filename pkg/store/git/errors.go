@@ -0,0 +1,47 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrTimeout is returned when a git operation exceeds the configured timeout
+	ErrTimeout = errors.New("timed out")
+
+	// ErrStopped is returned when a git operation was aborted by Stop
+	ErrStopped = errors.New("stopped")
+
+	// ErrNotRepository is returned when the local directory isn't a git repository
+	ErrNotRepository = errors.New("not a git repository")
+
+	// ErrRejected is returned when the remote repository refuses a push
+	ErrRejected = errors.New("rejected by remote")
+
+	// ErrUnknownRevision is returned when a revision can't be resolved
+	ErrUnknownRevision = errors.New("unknown revision")
+
+	// ErrSigning is returned when commits can't be signed
+	ErrSigning = errors.New("signing failed")
+)
+
+// Error describes a failed git operation. Err may be one of the ErrXxx
+// sentinel errors, to be tested with errors.Is. Credentials are redacted
+// from Err's message and from Output.
+type Error struct {
+	Op     string // git operation, ie. "clone" or "push"
+	Err    error  // underlying error
+	Output string // command output, if any
+}
+
+func (e *Error) Error() string {
+	if e.Output == "" {
+		return fmt.Sprintf("git %s failed: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("git %s failed: %v: %s", e.Op, e.Err, e.Output)
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
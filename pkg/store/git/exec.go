@@ -0,0 +1,419 @@
+package git
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// execDriver runs the git command found in $PATH
+type execDriver struct {
+	s *Store
+}
+
+// Git wraps the git command
+func (s *Store) Git(args ...string) error {
+	if s.DryRun {
+		return nil
+	}
+
+	_, err := s.output(args...)
+	return err
+}
+
+func (s *Store) output(args ...string) ([]byte, error) {
+	return s.outputEnv(nil, args...)
+}
+
+// outputEnv runs a git command with additional environment variables
+func (s *Store) outputEnv(env []string, args ...string) ([]byte, error) {
+	return s.run(env, false, args...)
+}
+
+// stdout runs a git command, returning its standard output only (ie. when
+// it's binary content), stderr being kept for the error message
+func (s *Store) stdout(args ...string) ([]byte, error) {
+	return s.run(nil, true, args...)
+}
+
+func (s *Store) run(env []string, stdoutOnly bool, args ...string) ([]byte, error) {
+	ctx, cancel := s.withTimeout()
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", args...) // #nosec
+	cmd.Dir = s.LocalDir
+	cmd.Env = append(os.Environ(), fmt.Sprintf("GIT_DIR=%s/.git", s.LocalDir))
+	cmd.Env = append(cmd.Env, s.authEnv()...)
+	cmd.Env = append(cmd.Env, env...)
+
+	var out, msg []byte
+	var err error
+	if stdoutOnly {
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err = cmd.Output()
+		msg = stderr.Bytes()
+	} else {
+		out, err = cmd.CombinedOutput()
+		msg = out
+	}
+
+	if err != nil {
+		switch ctx.Err() {
+		case context.DeadlineExceeded:
+			err = ErrTimeout
+		case context.Canceled:
+			err = ErrStopped
+		}
+		return nil, &Error{Op: args[0], Err: s.redactError(classify(err, msg)), Output: s.redact(strings.TrimSpace(string(msg)))}
+	}
+
+	return out, nil
+}
+
+// classify maps the git command output to our sentinel errors, when possible
+func classify(err error, out []byte) error {
+	if errors.Is(err, ErrTimeout) || errors.Is(err, ErrStopped) {
+		return err
+	}
+
+	msg := string(out)
+	switch {
+	case strings.Contains(msg, "not a git repository"):
+		return ErrNotRepository
+	case strings.Contains(msg, "[rejected]"), strings.Contains(msg, "non-fast-forward"):
+		return ErrRejected
+	case strings.Contains(msg, "failed to sign"), strings.Contains(msg, "gpg failed"),
+		strings.Contains(msg, "ssh-keygen"), strings.Contains(msg, "Couldn't load public key"),
+		strings.Contains(msg, "Couldn't sign"), strings.Contains(msg, "incorrect passphrase"):
+		return ErrSigning
+	case strings.Contains(msg, "unknown revision"), strings.Contains(msg, "bad revision"),
+		strings.Contains(msg, "not a valid object name"), strings.Contains(msg, "Not a valid object name"),
+		strings.Contains(msg, "couldn't find remote ref"):
+		return ErrUnknownRevision
+	}
+
+	return err
+}
+
+func (d *execDriver) initialize() error {
+	return d.s.Git("init", d.s.LocalDir)
+}
+
+func (d *execDriver) clone() error {
+	return d.s.Git("clone", "--depth=1", d.s.URL, d.s.LocalDir)
+}
+
+func (d *execDriver) configure() error {
+	err := d.s.Git("config", "user.name", d.s.Author)
+	if err != nil {
+		return err
+	}
+
+	return d.s.Git("config", "user.email", d.s.Email)
+}
+
+func (d *execDriver) status() (bool, error) {
+	out, err := d.s.output("status", "--porcelain")
+	if err != nil {
+		return false, err
+	}
+
+	return len(out) != 0, nil
+}
+
+// stageChunk bounds the number of paths per git command line
+const stageChunk = 1000
+
+func (d *execDriver) stage(paths []string) (bool, error) {
+	var present, missing []string
+	for _, path := range paths {
+		if _, err := os.Lstat(filepath.Join(d.s.LocalDir, path)); err == nil {
+			present = append(present, path)
+		} else {
+			missing = append(missing, path)
+		}
+	}
+
+	// paths are file names, not patterns
+	env := []string{"GIT_LITERAL_PATHSPECS=1"}
+	cmds := []struct {
+		args  []string
+		paths []string
+	}{
+		{[]string{"add", "--"}, present},
+		{[]string{"rm", "--cached", "--quiet", "--ignore-unmatch", "--"}, missing},
+	}
+
+	for _, cmd := range cmds {
+		for i := 0; i < len(cmd.paths); i += stageChunk {
+			end := i + stageChunk
+			if end > len(cmd.paths) {
+				end = len(cmd.paths)
+			}
+
+			args := append(append([]string{}, cmd.args...), cmd.paths[i:end]...)
+			if _, err := d.s.outputEnv(env, args...); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	out, err := d.s.output("diff", "--cached", "--name-only")
+	if err != nil {
+		return false, err
+	}
+
+	return len(out) != 0, nil
+}
+
+func (d *execDriver) commit(msg, author string, all bool) error {
+	if all {
+		err := d.s.Git("add", "-A")
+		if err != nil {
+			return err
+		}
+	}
+
+	args := []string{"commit", "-m", msg}
+	if author != "" {
+		args = append(args, "--author", fmt.Sprintf("%s <%s>", author, d.s.Email))
+	}
+	if d.s.signer != nil {
+		args = append(args, "-S")
+	}
+
+	_, err := d.s.outputEnv(d.s.signEnv(), args...)
+	return err
+}
+
+func (d *execDriver) checkout() error {
+	out, err := d.s.output("symbolic-ref", "--short", "HEAD")
+	if err == nil && strings.TrimSpace(string(out)) == d.s.Branch {
+		return nil
+	}
+
+	if d.s.Git("rev-parse", "--verify", "--quiet", "refs/heads/"+d.s.Branch) == nil {
+		return d.s.Git("checkout", d.s.Branch)
+	}
+
+	if d.s.URL != "" {
+		remote := "refs/remotes/origin/" + d.s.Branch
+		err = d.s.Git("fetch", "--depth=1", "origin", "+refs/heads/"+d.s.Branch+":"+remote)
+		if err == nil {
+			return d.s.Git("checkout", "-b", d.s.Branch, remote)
+		}
+		if !errors.Is(err, ErrUnknownRevision) {
+			return err
+		}
+	}
+
+	return d.s.Git("checkout", "-b", d.s.Branch)
+}
+
+func (d *execDriver) pull() error {
+	args := []string{"pull", "--no-rebase", "-s", "recursive", "-X", "ours", "--no-edit"}
+	if d.s.signer != nil {
+		args = append(args, "--gpg-sign")
+	}
+	if d.s.Branch == "" {
+		_, err := d.s.outputEnv(d.s.signEnv(), args...)
+		return err
+	}
+
+	_, err := d.s.outputEnv(d.s.signEnv(), append(args, "origin", d.s.Branch)...)
+	if errors.Is(err, ErrUnknownRevision) {
+		return nil // the branch wasn't pushed yet
+	}
+
+	return err
+}
+
+// branch returns the remote branch we track
+func (d *execDriver) branch() (string, error) {
+	if d.s.Branch != "" {
+		return d.s.Branch, nil
+	}
+
+	out, err := d.s.output("symbolic-ref", "--short", "HEAD")
+	return strings.TrimSpace(string(out)), err
+}
+
+func (d *execDriver) diverged() (ahead, behind bool, branch string, err error) {
+	branch, err = d.branch()
+	if err != nil {
+		return false, false, "", err
+	}
+
+	remote := "refs/remotes/origin/" + branch
+	err = d.s.Git("fetch", "origin", "+refs/heads/"+branch+":"+remote)
+	if errors.Is(err, ErrUnknownRevision) {
+		return false, false, branch, nil // the branch wasn't pushed yet
+	}
+	if err != nil {
+		return false, false, branch, err
+	}
+
+	out, err := d.s.output("rev-list", "--left-right", "--count", "HEAD..."+remote)
+	if err != nil {
+		return false, false, branch, err
+	}
+
+	var local, theirs int
+	if _, err = fmt.Sscanf(string(out), "%d %d", &local, &theirs); err != nil {
+		return false, false, branch, fmt.Errorf("unexpected rev-list output %q: %v", out, err)
+	}
+
+	return local > 0, theirs > 0, branch, nil
+}
+
+func (d *execDriver) rebase() error {
+	branch, err := d.branch()
+	if err != nil {
+		return err
+	}
+
+	// the recorder's latest changes may not be staged yet
+	args := []string{"rebase", "--autostash", "refs/remotes/origin/" + branch}
+	if d.s.signer != nil {
+		args = append(args, "--gpg-sign")
+	}
+
+	_, err = d.s.outputEnv(d.s.signEnv(), args...)
+	if err != nil {
+		_ = d.s.Git("rebase", "--abort")
+	}
+
+	return err
+}
+
+func (d *execDriver) reset() error {
+	branch, err := d.branch()
+	if err != nil {
+		return err
+	}
+
+	return d.s.Git("reset", "--mixed", "refs/remotes/origin/"+branch)
+}
+
+func (d *execDriver) pushTo(branch string) error {
+	return d.s.Git("push", "--force", "origin", "HEAD:refs/heads/"+branch)
+}
+
+func (d *execDriver) push() error {
+	if d.s.Branch == "" {
+		return d.s.Git("push")
+	}
+
+	return d.s.Git("push", "origin", "HEAD:refs/heads/"+d.s.Branch)
+}
+
+func (d *execDriver) tag(name, msg string) error {
+	args := []string{"tag", "-a", name, "-m", msg}
+	if d.s.signer != nil {
+		args = append(args, "-s")
+	}
+
+	_, err := d.s.outputEnv(d.s.signEnv(), args...)
+	return err
+}
+
+func (d *execDriver) tags(prefix string) (local, remote []string, err error) {
+	out, err := d.s.output("tag", "--list", prefix+"*")
+	if err != nil {
+		return nil, nil, err
+	}
+	local = strings.Fields(string(out))
+
+	if d.s.URL == "" {
+		return local, nil, nil
+	}
+
+	out, err = d.s.output("ls-remote", "--tags", "--refs", "origin", "refs/tags/"+prefix+"*")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			remote = append(remote, strings.TrimPrefix(fields[1], "refs/tags/"))
+		}
+	}
+
+	return local, remote, nil
+}
+
+func (d *execDriver) pushTags(push, remove []string) error {
+	if len(push)+len(remove) == 0 {
+		return nil
+	}
+
+	args := []string{"push", "origin"}
+	for _, tag := range push {
+		args = append(args, "refs/tags/"+tag+":refs/tags/"+tag)
+	}
+	for _, tag := range remove {
+		args = append(args, ":refs/tags/"+tag)
+	}
+
+	return d.s.Git(args...)
+}
+
+func (d *execDriver) deleteTags(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	return d.s.Git(append([]string{"tag", "--delete"}, names...)...)
+}
+
+func (d *execDriver) move(from, to string) error {
+	// git doesn't create the destination directory
+	err := os.MkdirAll(filepath.Join(d.s.LocalDir, filepath.Dir(to)), 0700)
+	if err != nil {
+		return err
+	}
+
+	return d.s.Git("mv", from, to)
+}
+
+func (d *execDriver) archive(rev string, write func(name string, data []byte) error) error {
+	out, err := d.s.stdout("archive", "--format=tar", rev)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(bytes.NewReader(out))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %v", err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %v", hdr.Name, err)
+		}
+
+		err = write(hdr.Name, data)
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %v", hdr.Name, err)
+		}
+	}
+}
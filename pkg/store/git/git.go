@@ -2,13 +2,18 @@ package git
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sync"
 	"time"
 
 	"github.com/spf13/afero"
+
+	"github.com/bpineau/katafygio/pkg/metrics"
+	"github.com/bpineau/katafygio/pkg/schedule"
 )
 
 var (
@@ -21,8 +26,25 @@ var (
 	// GitEmail is the email of the commiter
 	GitEmail = "katafygio@localhost"
 
-	// GitMsg is the commit message we'll use
+	// GitMsg is the commit message we'll use when we don't know what changed
 	GitMsg = "Kubernetes cluster change"
+
+	// GitMsgMaxObjects caps the number of changed objects listed in a commit message
+	GitMsgMaxObjects = 100
+
+	// MaxFailingDuration is how long commits or pushes may keep failing before
+	// we report the store as unready
+	MaxFailingDuration = 15 * time.Minute
+)
+
+const (
+	// DriverExec runs the git command found in $PATH
+	DriverExec = "exec"
+
+	// DriverNative uses an in-process (pure Go) git implementation
+	DriverNative = "native"
+
+	tempFilesPattern = ".temp-katafygio-*"
 )
 
 var appFs = afero.NewOsFs()
@@ -32,37 +54,139 @@ type logger interface {
 	Errorf(format string, args ...interface{})
 }
 
+// driver implements the actual git operations
+type driver interface {
+	initialize() error
+	clone() error
+	configure() error
+	status() (changed bool, err error)
+	commit(msg, author string, all bool) error
+	stage(paths []string) (changed bool, err error)
+	pull() error
+	push() error
+	archive(rev string, write func(name string, data []byte) error) error
+	move(from, to string) error
+	checkout() error
+	diverged() (ahead, behind bool, branch string, err error)
+	rebase() error
+	reset() error
+	pushTo(branch string) error
+	tag(name, msg string) error
+	tags(prefix string) (local, remote []string, err error)
+	pushTags(push, remove []string) error
+	deleteTags(names []string) error
+}
+
 // Store will maintain a git repository off dumped kube objects
 type Store struct {
-	Logger   logger
-	LocalDir string
-	URL      string
-	Timeout  time.Duration
-	Author   string
-	Email    string
-	Msg      string
-	DryRun   bool
-	stopch   chan struct{}
-	donech   chan struct{}
+	Logger        logger
+	LocalDir      string
+	URL           string
+	Branch        string
+	Timeout       time.Duration
+	Author        string
+	Email         string
+	Msg           string
+	MsgMaxObjects int
+	DryRun        bool
+	Driver        string
+	Auditor       Auditor
+	MaxFailing    time.Duration
+
+	// Remote repository credentials, as an alternative to credentials
+	// embedded in the URL (which may leak in processes arguments and logs)
+	SSHKeyFile     string // private key, for ssh urls
+	SSHPassphrase  string // private key passphrase, if any
+	KnownHostsFile string // default: the user's known_hosts
+	StrictHostKey  bool   // refuse unknown ssh hosts keys
+	Username       string // for https urls, with Token
+	Token          string // for https urls
+
+	// RedactPatterns matches are masked from git outputs and errors, in
+	// addition to urls credentials and the above secrets
+	RedactPatterns []*regexp.Regexp
+
+	// Sign commits with this GPG (armored) or SSH private key file. Commits
+	// fail, rather than being left unsigned, when signing fails.
+	SigningKey        string
+	SigningPassphrase string
+
+	// ConflictStrategy decides how diverged local and remote histories are
+	// reconciled (ConflictMerge, ConflictRebase, ConflictReset or
+	// ConflictSideBranch). ConflictBranch names the side branch.
+	ConflictStrategy string
+	ConflictBranch   string
+
+	// SnapshotSchedule is a cron-like expression (ie. "@monthly") telling
+	// when to tag the repository. The SnapshotKeep* retention counts tell
+	// how many hourly, daily and monthly snapshots to keep (when all are 0,
+	// every snapshot is kept).
+	SnapshotSchedule    string
+	SnapshotKeepHourly  int
+	SnapshotKeepDaily   int
+	SnapshotKeepMonthly int
+
+	// QuietPeriod delays commits until no change was notified (see Send)
+	// for that long, MaxBatchWindow caps how long a notified change may wait
+	// for a quiet period, and MaxCommitsPerHour caps the commits rate.
+	QuietPeriod       time.Duration
+	MaxBatchWindow    time.Duration
+	MaxCommitsPerHour int
+
+	// FullCheckInterval, when set, is the interval between full status
+	// scans of the local directory, catching the changes the recorder didn't
+	// notify (ie. manual edits). Otherwise, only the notified paths are
+	// staged, and the directory is fully scanned at start only.
+	FullCheckInterval time.Duration
+
+	askpass      string
+	snapshots    *schedule.Schedule
+	batch        batch
+	nextSnapshot time.Time
+	unpushed     bool // commits the loop didn't push yet
+	signer       *signer
+	health       health
+	ctx          context.Context // cancelled by Stop
+	cancel       context.CancelFunc
+	stopch       chan struct{}
+	donech       chan struct{}
+}
+
+// health tracks the synchronization loop activity, and failing operations
+type health struct {
+	sync.Mutex
+	lastLoop     time.Time
+	failingSince map[string]time.Time
+	lastErr      map[string]error
 }
 
 // New instantiate a new git Store. url is optional.
 func New(log logger, dryRun bool, dir, url string, timeout time.Duration) *Store {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Store{
-		Logger:   log,
-		LocalDir: dir,
-		URL:      url,
-		Timeout:  timeout,
-		Author:   GitAuthor,
-		Email:    GitEmail,
-		Msg:      GitMsg,
-		DryRun:   dryRun,
+		Logger:           log,
+		LocalDir:         dir,
+		URL:              url,
+		Timeout:          timeout,
+		Author:           GitAuthor,
+		Email:            GitEmail,
+		Msg:              GitMsg,
+		MsgMaxObjects:    GitMsgMaxObjects,
+		MaxFailing:       MaxFailingDuration,
+		DryRun:           dryRun,
+		Driver:           DriverExec,
+		StrictHostKey:    true,
+		ConflictStrategy: ConflictMerge,
+		Username:         "git",
+		ctx:              ctx,
+		cancel:           cancel,
 	}
 }
 
 // Start maintains a directory content committed
 func (s *Store) Start() (*Store, error) {
 	s.Logger.Infof("Starting git repository synchronizer")
+	s.ctx, s.cancel = context.WithCancel(context.Background())
 	s.stopch = make(chan struct{})
 	s.donech = make(chan struct{})
 
@@ -71,6 +195,8 @@ func (s *Store) Start() (*Store, error) {
 		return nil, err
 	}
 
+	s.loopAlive()
+
 	go func() {
 		checkTick := time.NewTicker(CheckInterval)
 		defer checkTick.Stop()
@@ -80,6 +206,7 @@ func (s *Store) Start() (*Store, error) {
 			select {
 			case <-checkTick.C:
 				s.commitAndPush()
+				s.loopAlive()
 			case <-s.stopch:
 				return
 			}
@@ -89,105 +216,153 @@ func (s *Store) Start() (*Store, error) {
 	return s, nil
 }
 
-// Stop stops the git goroutine
+// Stop stops the git goroutine (if started), and cleans up. In-flight git
+// operations are aborted rather than awaited (ie. so a replica which lost
+// the leader election lease stops pushing at once).
 func (s *Store) Stop() {
 	s.Logger.Infof("Stopping git repository synchronizer")
-	close(s.stopch)
-	<-s.donech
+	s.cancel()
+	if s.stopch != nil {
+		close(s.stopch)
+		<-s.donech
+	}
+	s.cleanupAuth()
+	s.cleanupSigning()
 }
 
-// Git wraps the git command
-func (s *Store) Git(args ...string) error {
-	if s.DryRun {
-		return nil
+func (s *Store) driver() driver {
+	if s.Driver == DriverNative {
+		return &nativeDriver{s}
 	}
+	return &execDriver{s}
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
-	defer cancel()
+// Status tests the git status of a repository
+func (s *Store) Status() (changed bool, err error) {
+	if s.DryRun {
+		return false, nil
+	}
 
-	cmd := exec.CommandContext(ctx, "git", args...) // #nosec
-	cmd.Dir = s.LocalDir
-	cmd.Env = append(os.Environ(), fmt.Sprintf("GIT_DIR=%s/.git", s.LocalDir))
+	return s.driver().status()
+}
 
-	out, err := cmd.CombinedOutput()
+// Archive extracts the repository content, as of the provided revision,
+// into the dest directory.
+func (s *Store) Archive(rev, dest string) (err error) {
+	s.LocalDir, err = filepath.Abs(s.LocalDir)
 	if err != nil {
-		if ctx.Err() == context.DeadlineExceeded {
-			return fmt.Errorf("git %s timed out (%v, %s)", args[0], err, out)
+		return fmt.Errorf("can't find local dir absolute path (broken cwd?): %v", err)
+	}
+
+	err = s.driver().archive(rev, func(name string, data []byte) error {
+		path := filepath.Join(dest, filepath.Clean("/"+name))
+		err := appFs.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %v", filepath.Dir(path), err)
 		}
-		return fmt.Errorf("git %s failed with code %v: %s", args[0], err, out)
+
+		return afero.WriteFile(appFs, path, data, 0600)
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to archive revision %s: %w", rev, err)
 	}
 
 	return nil
 }
 
-// Status tests the git status of a repository
-func (s *Store) Status() (changed bool, err error) {
+// Move renames a file tracked in the repository (paths are absolute, or
+// relative to the local directory), preserving its history.
+func (s *Store) Move(from, to string) error {
 	if s.DryRun {
-		return false, nil
+		return nil
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
-	defer cancel()
+	var err error
+	if from, err = s.relative(from); err != nil {
+		return err
+	}
+	if to, err = s.relative(to); err != nil {
+		return err
+	}
 
-	cmd := exec.CommandContext(ctx, "git", "status", "--porcelain") // #nosec
-	cmd.Dir = s.LocalDir
-	cmd.Env = append(os.Environ(), fmt.Sprintf("GIT_DIR=%s/.git", s.LocalDir))
+	s.notified(time.Now(), nil, from, to)
+	return s.driver().move(from, to)
+}
 
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		if ctx.Err() == context.DeadlineExceeded {
-			return false, fmt.Errorf("git status timed out (%v, %s)", err, out)
-		}
-		return false, fmt.Errorf("git status failed with code %v: %s", err, out)
+func (s *Store) relative(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return path, nil
 	}
 
-	if len(out) != 0 {
-		return true, nil
+	root, err := filepath.Abs(s.LocalDir)
+	if err != nil {
+		return "", err
 	}
 
-	return false, nil
+	return filepath.Rel(root, path)
 }
 
 // CloneOrInit create a new local repository, either with "git clone" (if a GitURL
 // to clone from is provided), or "git init" (in the absence of GitURL).
 func (s *Store) CloneOrInit() (err error) {
+	if s.Driver != DriverExec && s.Driver != DriverNative {
+		return fmt.Errorf("unknown git driver %q", s.Driver)
+	}
+
+	if err = s.checkConflictStrategy(); err != nil {
+		return err
+	}
+
+	if err = s.setupSnapshots(); err != nil {
+		return err
+	}
+
 	s.LocalDir, err = filepath.Abs(s.LocalDir)
 	if err != nil {
 		return fmt.Errorf("can't find local dir absolute path (broken cwd?): %v", err)
 	}
 
-	if !s.DryRun {
-		err = appFs.MkdirAll(s.LocalDir, 0700)
-		if err != nil {
-			return fmt.Errorf("failed to create %s: %v", s.LocalDir, err)
-		}
+	if s.DryRun {
+		return nil
 	}
 
-	// One may both sync with a remote repos and keep a persistent local clone
-	if _, err = os.Stat(fmt.Sprintf("%s/.git/index", s.LocalDir)); err == nil {
-		return nil
+	if err = s.setupSigning(); err != nil {
+		return err
 	}
 
-	if s.URL == "" {
-		err = s.Git("init", s.LocalDir)
-	} else {
-		err = s.Git("clone", "--depth=1", s.URL, s.LocalDir)
+	if err = s.setupAuth(); err != nil {
+		return err
 	}
 
+	err = appFs.MkdirAll(s.LocalDir, 0700)
 	if err != nil {
-		return fmt.Errorf("failed to init or clone in %s: %v", s.LocalDir, err)
+		return fmt.Errorf("failed to create %s: %v", s.LocalDir, err)
+	}
+
+	// One may both sync with a remote repos and keep a persistent local clone
+	if _, err = os.Stat(fmt.Sprintf("%s/.git/HEAD", s.LocalDir)); err == nil {
+		// the committer identity may have changed
+		if err = s.driver().configure(); err != nil {
+			return fmt.Errorf("failed to configure git in %s: %w", s.LocalDir, err)
+		}
+		return s.checkout()
+	}
+
+	if s.URL == "" {
+		err = s.driver().initialize()
+	} else {
+		s.Logger.Infof("Cloning %s into %s", s.redact(s.URL), s.LocalDir)
+		err = s.driver().clone()
 	}
 
-	err = s.Git("config", "user.name", s.Author)
 	if err != nil {
-		return fmt.Errorf("failed to config git user.name %s in %s: %v",
-			s.Author, s.LocalDir, err)
+		return fmt.Errorf("failed to init or clone in %s: %w", s.LocalDir, err)
 	}
 
-	err = s.Git("config", "user.email", s.Email)
+	err = s.driver().configure()
 	if err != nil {
-		return fmt.Errorf("failed to config git user.email %s in %s: %v",
-			s.Email, s.LocalDir, err)
+		return fmt.Errorf("failed to configure git in %s: %w", s.LocalDir, err)
 	}
 
 	err = appFs.MkdirAll(s.LocalDir+"/.git/info", 0744)
@@ -195,65 +370,237 @@ func (s *Store) CloneOrInit() (err error) {
 		return fmt.Errorf("failed to create git info directory: %v", err)
 	}
 
-	err = afero.WriteFile(appFs, s.LocalDir+"/.git/info/exclude", []byte(".temp-katafygio-*"), 0644)
+	err = afero.WriteFile(appFs, s.LocalDir+"/.git/info/exclude", []byte(tempFilesPattern), 0644)
 	if err != nil {
 		return fmt.Errorf("failed to create a git exclusion: %v", err)
 	}
 
+	return s.checkout()
+}
+
+// checkout switches to the configured Branch, if any. The branch is tracked
+// from the remote repository when it exists there, and otherwise created
+// from the current (ie. default) branch.
+func (s *Store) checkout() error {
+	if s.Branch == "" {
+		return nil
+	}
+
+	err := s.driver().checkout()
+	if err != nil {
+		return fmt.Errorf("failed to checkout branch %s in %s: %w", s.Branch, s.LocalDir, err)
+	}
+
 	return nil
 }
 
-// Commit git commit all the directory's changes
+// Commit git commit the directory's changes, with a message describing the
+// changes notified (through Send) since the last commit. When those changes
+// were all made by the same (known) user or field manager, it's used as the
+// commit author. Only the notified paths are staged, when known; otherwise
+// all the directory's changes are committed.
 func (s *Store) Commit() (changed bool, err error) {
-	changed, err = s.Status()
+	changed, _, err = s.commit()
+	return changed, err
+}
+
+// commit also tells if it scanned the whole directory (no path was notified)
+func (s *Store) commit() (changed, full bool, err error) {
+	if s.DryRun {
+		return false, false, nil
+	}
+
+	paths, full, changes := s.flush()
+	if full {
+		changed, err = s.Status()
+	} else {
+		changed, err = s.driver().stage(paths)
+	}
 	if err != nil {
-		return changed, err
+		s.restore(paths, full, changes)
+		metrics.GitFailures.WithLabelValues("commit").Inc()
+		s.reportResult("commit", err)
+		return changed, full, err
 	}
 
 	if !changed {
-		return false, nil
+		return false, full, nil
 	}
 
-	err = s.Git("add", "-A")
+	start := time.Now()
+	s.attribute(changes)
+	author := ""
+	if authors := changesAuthors(changes); len(authors) == 1 {
+		author = authors[0]
+	}
+
+	err = s.driver().commit(commitMessage(s.Msg, s.MsgMaxObjects, changes, s.audit), author, full)
 	if err != nil {
-		return false, fmt.Errorf("failed to git add -A: %v", err)
+		s.restore(paths, full, changes)
+		metrics.GitFailures.WithLabelValues("commit").Inc()
+		s.reportResult("commit", err)
+		if errors.Is(err, ErrSigning) {
+			s.reportResult("sign", err)
+		}
+		return false, full, fmt.Errorf("failed to git commit: %w", err)
 	}
 
-	err = s.Git("commit", "-m", s.Msg)
+	metrics.GitDuration.WithLabelValues("commit").Observe(time.Since(start).Seconds())
+	s.reportResult("commit", nil)
+	s.reportResult("sign", nil)
+
+	return true, full, nil
+}
+
+// Pull merges the remote changes, favoring local content on conflicts
+func (s *Store) Pull() error {
+	if s.DryRun || s.URL == "" {
+		return nil
+	}
+
+	err := s.driver().pull()
 	if err != nil {
-		return false, fmt.Errorf("failed to git commit: %v", err)
+		metrics.GitFailures.WithLabelValues("pull").Inc()
+		return fmt.Errorf("failed to git pull: %w", err)
 	}
 
-	return true, nil
+	return nil
 }
 
-// Push git push to the origin
+// Push git push to the origin, if any
 func (s *Store) Push() error {
-	err := s.Git("push")
+	if s.DryRun || s.URL == "" {
+		return nil
+	}
+
+	start := time.Now()
+	err := s.driver().push()
 	if err != nil {
-		return fmt.Errorf("failed to git push: %v", err)
+		metrics.GitFailures.WithLabelValues("push").Inc()
+		s.reportResult("push", err)
+		return fmt.Errorf("failed to git push: %w", err)
 	}
 
+	metrics.GitDuration.WithLabelValues("push").Observe(time.Since(start).Seconds())
+	s.reportResult("push", nil)
+
 	return nil
 }
 
+// commitAndPush commits the pending changes when the commit policies (or a
+// due snapshot) ask for it, then reconciles with and pushes to the remote
+// repository. Snapshots are only taken once their commit was pushed.
 func (s *Store) commitAndPush() {
-	changed, err := s.Commit()
-	if err != nil {
-		s.Logger.Errorf("%v", err)
+	start := time.Now()
+	snapshot := s.snapshotDue(start)
+
+	changed := false
+	if snapshot || s.commitDue(start) {
+		var full bool
+		var err error
+		changed, full, err = s.commit()
+		if err != nil {
+			s.Logger.Errorf("%v", err)
+			snapshot = false
+		} else {
+			s.committed(start, changed, full)
+		}
 	}
 
-	if !changed || s.URL == "" {
+	// retry conflicted repositories and failed pushes, even without new
+	// (or while batching) changes
+	s.unpushed = s.unpushed || changed
+	if (s.unpushed || s.Conflicted()) && s.URL != "" {
+		err := s.Reconcile()
+		if err == nil {
+			err = s.Push()
+		}
+		if err != nil {
+			s.Logger.Errorf("%v", err)
+			return
+		}
+		s.unpushed = false
+	}
+
+	if snapshot {
+		s.snapshot()
+	}
+}
+
+// withTimeout bounds a git operation by Timeout, and by Stop. As the
+// synchronization loop runs those one at a time, starting one is also a sign
+// of life (see Alive).
+func (s *Store) withTimeout() (context.Context, context.CancelFunc) {
+	s.loopAlive()
+	return context.WithTimeout(s.ctx, s.Timeout)
+}
+
+func (s *Store) loopAlive() {
+	s.health.Lock()
+	defer s.health.Unlock()
+	s.health.lastLoop = time.Now()
+}
+
+func (s *Store) reportResult(op string, err error) {
+	s.health.Lock()
+	defer s.health.Unlock()
+
+	if s.health.failingSince == nil {
+		s.health.failingSince = make(map[string]time.Time)
+		s.health.lastErr = make(map[string]error)
+	}
+
+	if err == nil {
+		delete(s.health.failingSince, op)
+		delete(s.health.lastErr, op)
 		return
 	}
 
-	err = s.Git("pull", "-s", "recursive", "-X", "ours", "--no-edit")
-	if err != nil {
-		s.Logger.Errorf("failed to git pull -s recursive -X ours --no-edit: %v", err)
+	if _, ok := s.health.failingSince[op]; !ok {
+		s.health.failingSince[op] = time.Now()
 	}
+	s.health.lastErr[op] = err
+}
 
-	err = s.Push()
-	if err != nil {
-		s.Logger.Errorf("%v", err)
+// Alive fails when the synchronization loop looks stuck. The loop records a
+// heartbeat at every check, and before each git command (or native network
+// operation), bounded by Timeout, however many operations a check runs.
+func (s *Store) Alive() error {
+	s.health.Lock()
+	defer s.health.Unlock()
+
+	if s.health.lastLoop.IsZero() {
+		return nil
+	}
+
+	if since := time.Since(s.health.lastLoop); since > 2*CheckInterval+s.Timeout {
+		return fmt.Errorf("git synchronization stalled for %s", since.Round(time.Second))
+	}
+
+	return nil
+}
+
+// Ready fails when commits or pushes kept failing for more than MaxFailing,
+// as soon as commits can't be signed (as this won't fix itself), or while
+// the local and remote histories can't be reconciled.
+func (s *Store) Ready() error {
+	s.health.Lock()
+	defer s.health.Unlock()
+
+	if err, ok := s.health.lastErr["sign"]; ok {
+		return fmt.Errorf("git commits signing failing: %v", err)
+	}
+
+	if err, ok := s.health.lastErr["conflict"]; ok {
+		return fmt.Errorf("git repository conflicted: %v", err)
+	}
+
+	for _, op := range []string{"commit", "push"} {
+		since, ok := s.health.failingSince[op]
+		if ok && time.Since(since) > s.MaxFailing {
+			return fmt.Errorf("git %s failing since %s: %v", op, since.Format(time.RFC3339), s.health.lastErr[op])
+		}
 	}
+
+	return nil
 }
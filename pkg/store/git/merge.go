@@ -0,0 +1,243 @@
+package git
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// go-git can't merge, so the native driver merges trees path by path: remote
+// changes are taken unless the same path also changed locally, in which case
+// the local content (reflecting the cluster's current state) wins.
+
+// blob identifies a file content in a tree
+type blob struct {
+	hash plumbing.Hash
+	mode filemode.FileMode
+}
+
+// treeFiles lists the files of a commit's tree (none for a nil commit)
+func treeFiles(commit *object.Commit) (map[string]blob, error) {
+	files := make(map[string]blob)
+	if commit == nil {
+		return files, nil
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	err = tree.Files().ForEach(func(f *object.File) error {
+		files[f.Name] = blob{f.Hash, f.Mode}
+		return nil
+	})
+
+	return files, err
+}
+
+// mergeFiles applies the changes theirs made since base to ours, except on
+// paths ours changed too
+func mergeFiles(base, ours, theirs map[string]blob) map[string]blob {
+	merged := make(map[string]blob, len(ours))
+	for path, b := range ours {
+		merged[path] = b
+	}
+
+	paths := make(map[string]bool)
+	for path := range base {
+		paths[path] = true
+	}
+	for path := range theirs {
+		paths[path] = true
+	}
+
+	for path := range paths {
+		b, inBase := base[path]
+		t, inTheirs := theirs[path]
+		o, inOurs := ours[path]
+
+		if inBase == inTheirs && b == t {
+			continue // unchanged remotely
+		}
+		if inBase != inOurs || b != o {
+			continue // changed on both sides: ours wins
+		}
+
+		if inTheirs {
+			merged[path] = t
+		} else {
+			delete(merged, path)
+		}
+	}
+
+	return merged
+}
+
+// writeTree stores the (nested) trees holding the files, and returns the root tree hash
+func writeTree(st storer.EncodedObjectStorer, files map[string]blob) (plumbing.Hash, error) {
+	tree := &object.Tree{}
+	subdirs := make(map[string]map[string]blob)
+	for path, b := range files {
+		if i := strings.Index(path, "/"); i >= 0 {
+			dir := path[:i]
+			if subdirs[dir] == nil {
+				subdirs[dir] = make(map[string]blob)
+			}
+			subdirs[dir][path[i+1:]] = b
+			continue
+		}
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: path, Mode: b.mode, Hash: b.hash})
+	}
+
+	for dir, sub := range subdirs {
+		hash, err := writeTree(st, sub)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: dir, Mode: filemode.Dir, Hash: hash})
+	}
+
+	// git sorts directories as if their name had a trailing slash
+	sortName := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(tree.Entries, func(i, j int) bool { return sortName(tree.Entries[i]) < sortName(tree.Entries[j]) })
+
+	obj := st.NewEncodedObject()
+	if err := tree.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return st.SetEncodedObject(obj)
+}
+
+// readWorktree returns a worktree file content (or a symlink's target)
+func readWorktree(full string) ([]byte, os.FileInfo, error) {
+	fi, err := os.Lstat(full)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(full)
+		return []byte(target), fi, err
+	}
+
+	data, err := ioutil.ReadFile(full)
+	return data, fi, err
+}
+
+// checkoutFiles moves the index and worktree from the from files to the to
+// files. Worktree files that don't match from (ie. the recorder changed
+// them since the last commit) are left alone, to be committed later.
+func (d *nativeDriver) checkoutFiles(repo *gogit.Repository, from, to map[string]blob) error {
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return err
+	}
+
+	paths := make(map[string]bool)
+	for path, b := range from {
+		if t, ok := to[path]; !ok || t != b {
+			paths[path] = true
+		}
+	}
+	for path := range to {
+		if _, ok := from[path]; !ok {
+			paths[path] = true
+		}
+	}
+
+	for path := range paths {
+		full := filepath.Join(d.s.LocalDir, filepath.FromSlash(path))
+		prev, tracked := from[path]
+		next, keep := to[path]
+
+		data, _, err := readWorktree(full)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		exists := err == nil
+		clean := exists == tracked &&
+			(!exists || plumbing.ComputeHash(plumbing.BlobObject, data) == prev.hash)
+
+		if clean {
+			if err = d.writeWorktree(repo, full, next, keep); err != nil {
+				return err
+			}
+		}
+
+		if !keep {
+			if _, err = idx.Remove(path); err != nil && !errors.Is(err, index.ErrEntryNotFound) {
+				return err
+			}
+			continue
+		}
+
+		entry, err := idx.Entry(path)
+		if errors.Is(err, index.ErrEntryNotFound) {
+			entry = idx.Add(path)
+		} else if err != nil {
+			return err
+		}
+		*entry = index.Entry{Name: path, Hash: next.hash, Mode: next.mode}
+	}
+
+	return repo.Storer.SetIndex(idx)
+}
+
+// writeWorktree replaces (or removes) a worktree file
+func (d *nativeDriver) writeWorktree(repo *gogit.Repository, full string, b blob, keep bool) error {
+	if !keep {
+		if err := os.Remove(full); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	obj, err := repo.BlobObject(b.hash)
+	if err != nil {
+		return err
+	}
+
+	r, err := obj.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(full), 0700); err != nil {
+		return err
+	}
+	_ = os.Remove(full)
+
+	if b.mode == filemode.Symlink {
+		return os.Symlink(string(data), full)
+	}
+
+	mode := os.FileMode(0600)
+	if b.mode == filemode.Executable {
+		mode = 0700
+	}
+
+	return ioutil.WriteFile(full, data, mode)
+}
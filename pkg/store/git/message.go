@@ -0,0 +1,190 @@
+package git
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bpineau/katafygio/pkg/event"
+)
+
+const (
+	// maxSummaryLen is the max length of a commit message summary listing objects
+	maxSummaryLen = 72
+
+	// authorTrailer names the commit message trailers listing the changes authors
+	authorTrailer = "Changed-by"
+)
+
+var verbs = map[event.Action]string{
+	event.Upsert: "update",
+	event.Delete: "delete",
+}
+
+// Auditor tells who last changed an object, as reported by the API server audit.
+// Kinds are qualified by their API group, ie. "deployment.apps".
+type Auditor interface {
+	Audit(kind, key string) *event.Audit
+}
+
+// Send records a change notification, to be described in the next commit message
+func (s *Store) Send(notif *event.Notification) {
+	if notif.Key == "" {
+		// not an object change (ie. a garbage collected file)
+		s.notified(time.Now(), nil, notif.Path)
+		return
+	}
+
+	s.notified(time.Now(), &event.Notification{
+		Action:  notif.Action,
+		Key:     notif.Key,
+		Kind:    notif.Kind,
+		Group:   notif.Group,
+		Version: notif.Version,
+		Author:  notif.Author,
+		Cluster: notif.Cluster,
+	}, notif.Path)
+}
+
+// audit returns the audited change matching a notification, if any
+func (s *Store) audit(ch event.Notification) *event.Audit {
+	if s.Auditor == nil {
+		return nil
+	}
+
+	audit := s.Auditor.Audit(ch.QualifiedKind(), ch.Key)
+	if audit == nil || (audit.Verb == "delete") != (ch.Action == event.Delete) {
+		// not audited yet, or stale
+		return nil
+	}
+
+	return audit
+}
+
+// attribute replaces the changes authors with the audited users, when known
+func (s *Store) attribute(changes []event.Notification) {
+	for i := range changes {
+		if audit := s.audit(changes[i]); audit != nil {
+			changes[i].Author = audit.User
+		}
+	}
+}
+
+// squashChanges sorts the changes by object, keeping the last change of each
+// object (an object may change several times between two commits).
+func squashChanges(changes []event.Notification) []event.Notification {
+	last := make(map[string]event.Notification)
+	for _, ch := range changes {
+		last[objectName(ch)] = ch
+	}
+
+	ids := make([]string, 0, len(last))
+	for id := range last {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	squashed := make([]event.Notification, 0, len(ids))
+	for _, id := range ids {
+		squashed = append(squashed, last[id])
+	}
+
+	return squashed
+}
+
+// objectName describes a changed object, ie. "deployment.apps default/api"
+// (or "deployment.apps prod:default/api" when the change comes from the
+// "prod" cluster, in multi-cluster mode).
+func objectName(ch event.Notification) string {
+	if ch.Cluster == "" {
+		return ch.QualifiedKind() + " " + ch.Key
+	}
+	return ch.QualifiedKind() + " " + ch.Cluster + ":" + ch.Key
+}
+
+// changesAuthors returns the distinct (known) authors of a batch of changes
+func changesAuthors(changes []event.Notification) []string {
+	seen := make(map[string]bool)
+	var authors []string
+	for _, ch := range squashChanges(changes) {
+		if ch.Author != "" && !seen[ch.Author] {
+			seen[ch.Author] = true
+			authors = append(authors, ch.Author)
+		}
+	}
+
+	sort.Strings(authors)
+	return authors
+}
+
+// commitMessage describes a batch of changes: a summary line (listing the
+// objects when that's short enough, or else counting them by action) followed
+// by the list of changed objects (with audit details, when known), capped at
+// maxObjects, and by trailers naming the changes authors. We fallback to the
+// msg message when no changes were recorded (ie. files garbage collection).
+func commitMessage(msg string, maxObjects int, changes []event.Notification,
+	audit func(event.Notification) *event.Audit) string {
+	if len(changes) == 0 {
+		return msg
+	}
+
+	counts := make(map[event.Action]int)
+	var lines, details []string
+	audited := false
+	for _, ch := range squashChanges(changes) {
+		counts[ch.Action]++
+		line := fmt.Sprintf("%s %s", verbs[ch.Action], objectName(ch))
+		lines = append(lines, line)
+
+		if a := audit(ch); a != nil {
+			line += fmt.Sprintf(" (%s by %s at %s)", a.Verb, a.User, a.Time.UTC().Format(time.RFC3339))
+			audited = true
+		}
+		details = append(details, line)
+	}
+
+	var trailers string
+	for _, author := range changesAuthors(changes) {
+		trailers += fmt.Sprintf("%s: %s\n", authorTrailer, author)
+	}
+
+	summary := strings.Join(lines, ", ")
+	if len(summary) <= maxSummaryLen && !audited {
+		if trailers == "" {
+			return summary
+		}
+		return summary + "\n\n" + trailers
+	}
+
+	if len(summary) > maxSummaryLen {
+		summary = countChanges(counts)
+	}
+
+	if maxObjects >= 0 && len(details) > maxObjects {
+		more := len(details) - maxObjects
+		details = append(details[:maxObjects], fmt.Sprintf("... and %d more", more))
+	}
+
+	msg = summary + "\n\n" + strings.Join(details, "\n") + "\n"
+	if trailers != "" {
+		msg += "\n" + trailers
+	}
+
+	return msg
+}
+
+// countChanges summarizes changes by action, ie. "update 3 objects, delete 1 object"
+func countChanges(counts map[event.Action]int) string {
+	var parts []string
+	for _, action := range []event.Action{event.Upsert, event.Delete} {
+		switch counts[action] {
+		case 0:
+		case 1:
+			parts = append(parts, fmt.Sprintf("%s 1 object", verbs[action]))
+		default:
+			parts = append(parts, fmt.Sprintf("%s %d objects", verbs[action], counts[action]))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,811 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// nativeDriver uses go-git, an in-process git implementation, so we don't
+// depend on a git binary being available.
+type nativeDriver struct {
+	s *Store
+}
+
+func (d *nativeDriver) wrap(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		err = ErrTimeout
+	case errors.Is(err, context.Canceled):
+		err = ErrStopped
+	case errors.Is(err, gogit.ErrRepositoryNotExists):
+		err = ErrNotRepository
+	case errors.Is(err, plumbing.ErrReferenceNotFound), errors.Is(err, plumbing.ErrObjectNotFound):
+		err = ErrUnknownRevision
+	case errors.Is(err, gogit.ErrForceNeeded), errors.Is(err, gogit.ErrNonFastForwardUpdate),
+		strings.Contains(err.Error(), "non-fast-forward"), strings.Contains(err.Error(), "rejected"):
+		err = fmt.Errorf("%w: %v", ErrRejected, err)
+	}
+
+	return &Error{Op: op, Err: d.s.redactError(err)}
+}
+
+func (d *nativeDriver) open() (*gogit.Repository, *gogit.Worktree, error) {
+	repo, err := gogit.PlainOpen(d.s.LocalDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// go-git doesn't honor .git/info/exclude
+	wt.Excludes = append(wt.Excludes, gitignore.ParsePattern(tempFilesPattern, nil))
+
+	return repo, wt, nil
+}
+
+func (d *nativeDriver) signature() *object.Signature {
+	return &object.Signature{
+		Name:  d.s.Author,
+		Email: d.s.Email,
+		When:  time.Now(),
+	}
+}
+
+// sign returns a commit's armored signature
+func (d *nativeDriver) sign(commit *object.Commit) (string, error) {
+	unsigned := &plumbing.MemoryObject{}
+	if err := commit.EncodeWithoutSignature(unsigned); err != nil {
+		return "", err
+	}
+
+	r, err := unsigned.Reader()
+	if err != nil {
+		return "", err
+	}
+
+	var sig bytes.Buffer
+	if err = openpgp.ArmoredDetachSign(&sig, d.s.signer.entity, r, nil); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrSigning, err)
+	}
+
+	return sig.String(), nil
+}
+
+func (d *nativeDriver) initialize() error {
+	_, err := gogit.PlainInit(d.s.LocalDir, false)
+	return d.wrap("init", err)
+}
+
+func (d *nativeDriver) clone() error {
+	ctx, cancel := d.s.withTimeout()
+	defer cancel()
+
+	auth, err := d.s.authMethod()
+	if err != nil {
+		return d.wrap("clone", err)
+	}
+
+	opts := &gogit.CloneOptions{URL: d.s.URL, Auth: auth}
+	if d.s.Branch != "" {
+		opts.ReferenceName = plumbing.NewBranchReferenceName(d.s.Branch)
+	}
+
+	_, err = gogit.PlainCloneContext(ctx, d.s.LocalDir, false, opts)
+	if errors.Is(err, transport.ErrEmptyRemoteRepository) || errors.Is(err, plumbing.ErrReferenceNotFound) {
+		// cloning an empty remote (or one whose HEAD or branch doesn't exist
+		// yet): start a fresh repository tracking it, checkout will handle
+		// the branch
+		return d.initEmptyClone()
+	}
+
+	return d.wrap("clone", err)
+}
+
+func (d *nativeDriver) initEmptyClone() error {
+	repo, err := gogit.PlainInit(d.s.LocalDir, false)
+	if err != nil {
+		return d.wrap("clone", err)
+	}
+
+	_, err = repo.CreateRemote(&config.RemoteConfig{Name: gogit.DefaultRemoteName, URLs: []string{d.s.URL}})
+	return d.wrap("clone", err)
+}
+
+func (d *nativeDriver) configure() error {
+	repo, err := gogit.PlainOpen(d.s.LocalDir)
+	if err != nil {
+		return d.wrap("config", err)
+	}
+
+	cfg, err := repo.Config()
+	if err != nil {
+		return d.wrap("config", err)
+	}
+
+	cfg.User.Name = d.s.Author
+	cfg.User.Email = d.s.Email
+
+	return d.wrap("config", repo.SetConfig(cfg))
+}
+
+func (d *nativeDriver) status() (bool, error) {
+	_, wt, err := d.open()
+	if err != nil {
+		return false, d.wrap("status", err)
+	}
+
+	st, err := wt.Status()
+	if err != nil {
+		return false, d.wrap("status", err)
+	}
+
+	return !st.IsClean(), nil
+}
+
+// stage updates the index entries of the provided paths directly, as go-git's
+// Worktree.Add scans the whole worktree status.
+func (d *nativeDriver) stage(paths []string) (bool, error) {
+	repo, _, err := d.open()
+	if err != nil {
+		return false, d.wrap("add", err)
+	}
+
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return false, d.wrap("add", err)
+	}
+
+	for _, path := range paths {
+		if err = d.stagePath(repo, idx, path); err != nil {
+			return false, d.wrap("add", err)
+		}
+	}
+
+	if err = repo.Storer.SetIndex(idx); err != nil {
+		return false, d.wrap("add", err)
+	}
+
+	return d.staged(repo, idx, paths)
+}
+
+// stagePath stores the file's content as a blob and updates its index entry,
+// or removes the entry when the file is gone
+func (d *nativeDriver) stagePath(repo *gogit.Repository, idx *index.Index, path string) error {
+	data, fi, err := readWorktree(filepath.Join(d.s.LocalDir, filepath.FromSlash(path)))
+	if os.IsNotExist(err) {
+		_, err = idx.Remove(path)
+		if errors.Is(err, index.ErrEntryNotFound) {
+			return nil
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	mode, err := filemode.NewFromOSFileMode(fi.Mode())
+	if err != nil {
+		return err
+	}
+
+	obj := repo.Storer.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	obj.SetSize(int64(len(data)))
+	w, err := obj.Writer()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(data); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	hash, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return err
+	}
+
+	entry, err := idx.Entry(path)
+	if errors.Is(err, index.ErrEntryNotFound) {
+		entry = idx.Add(path)
+	} else if err != nil {
+		return err
+	}
+
+	entry.Hash = hash
+	entry.Mode = mode
+	entry.ModifiedAt = fi.ModTime()
+	entry.Size = uint32(fi.Size())
+
+	return nil
+}
+
+// staged tells if the index differs from HEAD for any of the provided paths
+func (d *nativeDriver) staged(repo *gogit.Repository, idx *index.Index, paths []string) (bool, error) {
+	var tree *object.Tree
+	head, err := repo.Head()
+	if err == nil {
+		var commit *object.Commit
+		if commit, err = repo.CommitObject(head.Hash()); err == nil {
+			tree, err = commit.Tree()
+		}
+	}
+	if err != nil && !errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return false, d.wrap("status", err)
+	}
+
+	for _, path := range paths {
+		entry, err := idx.Entry(path)
+		if err != nil && !errors.Is(err, index.ErrEntryNotFound) {
+			return false, d.wrap("status", err)
+		}
+
+		var committed *object.TreeEntry
+		if tree != nil {
+			committed, err = tree.FindEntry(path)
+			if err != nil && !errors.Is(err, object.ErrEntryNotFound) &&
+				!errors.Is(err, object.ErrDirectoryNotFound) {
+				return false, d.wrap("status", err)
+			}
+		}
+
+		switch {
+		case entry == nil && committed == nil:
+			continue
+		case entry == nil || committed == nil:
+			return true, nil
+		case entry.Hash != committed.Hash || entry.Mode != committed.Mode:
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (d *nativeDriver) commit(msg, author string, all bool) error {
+	_, wt, err := d.open()
+	if err != nil {
+		return d.wrap("commit", err)
+	}
+
+	if all {
+		// adds new and modified files; deletions are staged by the commit's All option
+		err = wt.AddWithOptions(&gogit.AddOptions{All: true})
+		if err != nil {
+			return d.wrap("add", err)
+		}
+	}
+
+	opts := &gogit.CommitOptions{All: all, Author: d.signature(), Committer: d.signature()}
+	if d.s.signer != nil {
+		opts.SignKey = d.s.signer.entity
+	}
+	if author != "" {
+		opts.Author.Name = author
+	}
+
+	_, err = wt.Commit(msg, opts)
+	return d.wrap("commit", err)
+}
+
+// pull fetches the remote branch, and fast-forwards to it or merges it. On
+// paths changed on both sides, the local content (which reflects the
+// cluster's current state) wins; other remote changes are kept.
+func (d *nativeDriver) pull() error {
+	repo, _, err := d.open()
+	if err != nil {
+		return d.wrap("pull", err)
+	}
+
+	if err = d.fetch(repo); err != nil {
+		return d.wrap("pull", err)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return d.wrap("pull", err)
+	}
+
+	remoteName := plumbing.NewRemoteReferenceName(gogit.DefaultRemoteName, head.Name().Short())
+	remote, err := repo.Reference(remoteName, true)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return nil // nothing to merge yet
+	}
+	if err != nil {
+		return d.wrap("pull", err)
+	}
+
+	local, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return d.wrap("pull", err)
+	}
+
+	theirs, err := repo.CommitObject(remote.Hash())
+	if err != nil {
+		return d.wrap("pull", err)
+	}
+
+	if merged, err := theirs.IsAncestor(local); err != nil || merged {
+		return d.wrap("pull", err)
+	}
+
+	ours, err := treeFiles(local)
+	if err != nil {
+		return d.wrap("pull", err)
+	}
+
+	files, err := treeFiles(theirs)
+	if err != nil {
+		return d.wrap("pull", err)
+	}
+
+	target := theirs.Hash
+	ffwd, err := local.IsAncestor(theirs)
+	if err != nil {
+		return d.wrap("pull", err)
+	}
+
+	if !ffwd {
+		target, files, err = d.merge(repo, local, theirs, ours, files, remoteName)
+		if err != nil {
+			return d.wrap("pull", err)
+		}
+	}
+
+	if err = d.checkoutFiles(repo, ours, files); err != nil {
+		return d.wrap("pull", err)
+	}
+
+	return d.wrap("pull", repo.Storer.SetReference(plumbing.NewHashReference(head.Name(), target)))
+}
+
+// merge creates a merge commit of the local and remote commits, and returns
+// it with its files
+func (d *nativeDriver) merge(repo *gogit.Repository, local, theirs *object.Commit,
+	ours, remote map[string]blob, remoteName plumbing.ReferenceName) (plumbing.Hash, map[string]blob, error) {
+	var base *object.Commit
+	bases, err := local.MergeBase(theirs)
+	if err != nil {
+		return plumbing.ZeroHash, nil, err
+	}
+	if len(bases) > 0 {
+		base = bases[0]
+	}
+
+	baseFiles, err := treeFiles(base)
+	if err != nil {
+		return plumbing.ZeroHash, nil, err
+	}
+
+	files := mergeFiles(baseFiles, ours, remote)
+	tree, err := writeTree(repo.Storer, files)
+	if err != nil {
+		return plumbing.ZeroHash, nil, err
+	}
+
+	merge := &object.Commit{
+		Author:       *d.signature(),
+		Committer:    *d.signature(),
+		Message:      fmt.Sprintf("Merge remote-tracking branch '%s'", remoteName.Short()),
+		TreeHash:     tree,
+		ParentHashes: []plumbing.Hash{local.Hash, theirs.Hash},
+	}
+
+	if d.s.signer != nil {
+		if merge.PGPSignature, err = d.sign(merge); err != nil {
+			return plumbing.ZeroHash, nil, err
+		}
+	}
+
+	obj := repo.Storer.NewEncodedObject()
+	if err = merge.Encode(obj); err != nil {
+		return plumbing.ZeroHash, nil, err
+	}
+
+	hash, err := repo.Storer.SetEncodedObject(obj)
+	return hash, files, err
+}
+
+// fetch updates the remote branches
+func (d *nativeDriver) fetch(repo *gogit.Repository) error {
+	ctx, cancel := d.s.withTimeout()
+	defer cancel()
+
+	auth, err := d.s.authMethod()
+	if err != nil {
+		return err
+	}
+
+	err = repo.FetchContext(ctx, &gogit.FetchOptions{Auth: auth})
+	if errors.Is(err, gogit.NoErrAlreadyUpToDate) || errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		return nil
+	}
+
+	return err
+}
+
+func (d *nativeDriver) diverged() (ahead, behind bool, branch string, err error) {
+	repo, _, err := d.open()
+	if err != nil {
+		return false, false, "", d.wrap("fetch", err)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return false, false, "", d.wrap("fetch", err)
+	}
+	branch = head.Name().Short()
+
+	if err = d.fetch(repo); err != nil {
+		return false, false, branch, d.wrap("fetch", err)
+	}
+
+	remote, err := repo.Reference(plumbing.NewRemoteReferenceName(gogit.DefaultRemoteName, branch), true)
+	if errors.Is(err, plumbing.ErrReferenceNotFound) {
+		return false, false, branch, nil // the branch wasn't pushed yet
+	}
+	if err != nil {
+		return false, false, branch, d.wrap("fetch", err)
+	}
+
+	if remote.Hash() == head.Hash() {
+		return false, false, branch, nil
+	}
+
+	local, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return false, false, branch, d.wrap("fetch", err)
+	}
+
+	theirs, err := repo.CommitObject(remote.Hash())
+	if err != nil {
+		return false, false, branch, d.wrap("fetch", err)
+	}
+
+	merged, err := theirs.IsAncestor(local)
+	if err != nil {
+		return false, false, branch, d.wrap("fetch", err)
+	}
+
+	ffwd, err := local.IsAncestor(theirs)
+	if err != nil {
+		return false, false, branch, d.wrap("fetch", err)
+	}
+
+	return !ffwd, !merged, branch, nil
+}
+
+func (d *nativeDriver) rebase() error {
+	return d.wrap("rebase", fmt.Errorf("not supported by the %s driver", DriverNative))
+}
+
+func (d *nativeDriver) reset() error {
+	repo, wt, err := d.open()
+	if err != nil {
+		return d.wrap("reset", err)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return d.wrap("reset", err)
+	}
+
+	remote, err := repo.Reference(plumbing.NewRemoteReferenceName(gogit.DefaultRemoteName, head.Name().Short()), true)
+	if err != nil {
+		return d.wrap("reset", err)
+	}
+
+	return d.wrap("reset", wt.Reset(&gogit.ResetOptions{Commit: remote.Hash(), Mode: gogit.MixedReset}))
+}
+
+func (d *nativeDriver) pushTo(branch string) error {
+	ctx, cancel := d.s.withTimeout()
+	defer cancel()
+
+	repo, _, err := d.open()
+	if err != nil {
+		return d.wrap("push", err)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return d.wrap("push", err)
+	}
+
+	auth, err := d.s.authMethod()
+	if err != nil {
+		return d.wrap("push", err)
+	}
+
+	spec := config.RefSpec("+" + head.Name() + ":" + plumbing.NewBranchReferenceName(branch))
+	err = repo.PushContext(ctx, &gogit.PushOptions{Auth: auth, RefSpecs: []config.RefSpec{spec}})
+	if errors.Is(err, gogit.NoErrAlreadyUpToDate) {
+		return nil
+	}
+
+	return d.wrap("push", err)
+}
+
+func (d *nativeDriver) tag(name, msg string) error {
+	repo, _, err := d.open()
+	if err != nil {
+		return d.wrap("tag", err)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return d.wrap("tag", err)
+	}
+
+	opts := &gogit.CreateTagOptions{Tagger: d.signature(), Message: msg}
+	if d.s.signer != nil {
+		opts.SignKey = d.s.signer.entity
+	}
+
+	_, err = repo.CreateTag(name, head.Hash(), opts)
+	return d.wrap("tag", err)
+}
+
+func (d *nativeDriver) tags(prefix string) (local, remote []string, err error) {
+	repo, _, err := d.open()
+	if err != nil {
+		return nil, nil, d.wrap("tag", err)
+	}
+
+	refs, err := repo.Tags()
+	if err != nil {
+		return nil, nil, d.wrap("tag", err)
+	}
+
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if name := ref.Name().Short(); strings.HasPrefix(name, prefix) {
+			local = append(local, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, d.wrap("tag", err)
+	}
+
+	if d.s.URL == "" {
+		return local, nil, nil
+	}
+
+	ctx, cancel := d.s.withTimeout()
+	defer cancel()
+
+	auth, err := d.s.authMethod()
+	if err != nil {
+		return nil, nil, d.wrap("ls-remote", err)
+	}
+
+	origin, err := repo.Remote(gogit.DefaultRemoteName)
+	if err != nil {
+		return nil, nil, d.wrap("ls-remote", err)
+	}
+
+	list, err := origin.ListContext(ctx, &gogit.ListOptions{Auth: auth})
+	if err != nil && !errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		return nil, nil, d.wrap("ls-remote", err)
+	}
+
+	for _, ref := range list {
+		if name := ref.Name().Short(); ref.Name().IsTag() && strings.HasPrefix(name, prefix) {
+			remote = append(remote, name)
+		}
+	}
+
+	return local, remote, nil
+}
+
+func (d *nativeDriver) pushTags(push, remove []string) error {
+	if len(push)+len(remove) == 0 {
+		return nil
+	}
+
+	ctx, cancel := d.s.withTimeout()
+	defer cancel()
+
+	repo, _, err := d.open()
+	if err != nil {
+		return d.wrap("push", err)
+	}
+
+	auth, err := d.s.authMethod()
+	if err != nil {
+		return d.wrap("push", err)
+	}
+
+	var specs []config.RefSpec
+	for _, tag := range push {
+		ref := plumbing.NewTagReferenceName(tag)
+		specs = append(specs, config.RefSpec(ref+":"+ref))
+	}
+	for _, tag := range remove {
+		specs = append(specs, config.RefSpec(":"+plumbing.NewTagReferenceName(tag)))
+	}
+
+	err = repo.PushContext(ctx, &gogit.PushOptions{Auth: auth, RefSpecs: specs})
+	if errors.Is(err, gogit.NoErrAlreadyUpToDate) {
+		return nil
+	}
+
+	return d.wrap("push", err)
+}
+
+func (d *nativeDriver) deleteTags(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	repo, _, err := d.open()
+	if err != nil {
+		return d.wrap("tag", err)
+	}
+
+	for _, name := range names {
+		if err = repo.DeleteTag(name); err != nil {
+			return d.wrap("tag", err)
+		}
+	}
+
+	return nil
+}
+
+func (d *nativeDriver) push() error {
+	ctx, cancel := d.s.withTimeout()
+	defer cancel()
+
+	repo, _, err := d.open()
+	if err != nil {
+		return d.wrap("push", err)
+	}
+
+	auth, err := d.s.authMethod()
+	if err != nil {
+		return d.wrap("push", err)
+	}
+
+	opts := &gogit.PushOptions{Auth: auth}
+	if d.s.Branch != "" {
+		ref := plumbing.NewBranchReferenceName(d.s.Branch)
+		opts.RefSpecs = []config.RefSpec{config.RefSpec(ref + ":" + ref)}
+	}
+
+	err = repo.PushContext(ctx, opts)
+	if errors.Is(err, gogit.NoErrAlreadyUpToDate) {
+		return nil
+	}
+
+	return d.wrap("push", err)
+}
+
+func (d *nativeDriver) checkout() error {
+	repo, wt, err := d.open()
+	if err != nil {
+		return d.wrap("checkout", err)
+	}
+
+	branch := plumbing.NewBranchReferenceName(d.s.Branch)
+	head, err := repo.Head()
+	if err == nil && head.Name() == branch {
+		return nil
+	}
+
+	if _, err = repo.Reference(branch, false); err == nil {
+		return d.wrap("checkout", wt.Checkout(&gogit.CheckoutOptions{Branch: branch}))
+	}
+
+	if d.s.URL != "" {
+		ctx, cancel := d.s.withTimeout()
+		defer cancel()
+
+		auth, err := d.s.authMethod()
+		if err != nil {
+			return d.wrap("checkout", err)
+		}
+
+		remote := plumbing.NewRemoteReferenceName(gogit.DefaultRemoteName, d.s.Branch)
+		err = repo.FetchContext(ctx, &gogit.FetchOptions{
+			Auth:     auth,
+			RefSpecs: []config.RefSpec{config.RefSpec("+" + branch + ":" + remote)},
+		})
+
+		switch {
+		case err == nil, errors.Is(err, gogit.NoErrAlreadyUpToDate):
+			ref, err := repo.Reference(remote, true)
+			if err != nil {
+				return d.wrap("checkout", err)
+			}
+			return d.wrap("checkout", wt.Checkout(&gogit.CheckoutOptions{Branch: branch, Hash: ref.Hash(), Create: true}))
+		case errors.Is(err, gogit.NoMatchingRefSpecError{}), errors.Is(err, transport.ErrEmptyRemoteRepository):
+			// not pushed yet
+		default:
+			return d.wrap("checkout", err)
+		}
+	}
+
+	if _, err = repo.Head(); errors.Is(err, plumbing.ErrReferenceNotFound) {
+		// no commit yet: the branch will be created by the first commit
+		return d.wrap("checkout", repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branch)))
+	}
+
+	return d.wrap("checkout", wt.Checkout(&gogit.CheckoutOptions{Branch: branch, Create: true}))
+}
+
+func (d *nativeDriver) move(from, to string) error {
+	_, wt, err := d.open()
+	if err != nil {
+		return d.wrap("mv", err)
+	}
+
+	_, err = wt.Move(from, to)
+	return d.wrap("mv", err)
+}
+
+func (d *nativeDriver) archive(rev string, write func(name string, data []byte) error) error {
+	repo, _, err := d.open()
+	if err != nil {
+		return d.wrap("archive", err)
+	}
+
+	hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return d.wrap("archive", err)
+	}
+
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return d.wrap("archive", err)
+	}
+
+	files, err := commit.Files()
+	if err != nil {
+		return d.wrap("archive", err)
+	}
+
+	err = files.ForEach(func(f *object.File) error {
+		if f.Mode != filemode.Regular && f.Mode != filemode.Executable {
+			return nil
+		}
+
+		data, err := f.Contents()
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %v", f.Name, err)
+		}
+
+		err = write(f.Name, []byte(data))
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %v", f.Name, err)
+		}
+
+		return nil
+	})
+
+	return d.wrap("archive", err)
+}
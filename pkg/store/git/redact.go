@@ -0,0 +1,72 @@
+package git
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// redactedMark replaces the secrets found in git outputs and errors
+const redactedMark = "[redacted]"
+
+// urlUserinfo matches the credentials part of urls, ie. "user:token@"
+var urlUserinfo = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/@\s'"]+@`)
+
+// redactedError masks credentials in an error message, while preserving the
+// errors chain (for errors.Is)
+type redactedError struct {
+	err error
+	msg string
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// secrets returns the known credentials: the token, the ssh and signing keys
+// passphrases, and the password embedded in the url, if any. A bare username
+// (ie. "git" in "ssh://git@host/repo") isn't a secret.
+func (s *Store) secrets() []string {
+	secrets := []string{s.Token, s.SSHPassphrase, s.SigningPassphrase}
+	if u, err := url.Parse(s.URL); err == nil && u.User != nil {
+		if pass, ok := u.User.Password(); ok && pass != "" {
+			secrets = append(secrets, pass, u.User.String())
+		}
+	}
+	return secrets
+}
+
+// redact strips urls userinfo, and masks known secrets and RedactPatterns
+// matches from a git output or error message.
+func (s *Store) redact(text string) string {
+	text = urlUserinfo.ReplaceAllString(text, "$1")
+
+	for _, secret := range s.secrets() {
+		if secret != "" {
+			text = strings.ReplaceAll(text, secret, redactedMark)
+		}
+	}
+
+	for _, re := range s.RedactPatterns {
+		text = re.ReplaceAllString(text, redactedMark)
+	}
+
+	return text
+}
+
+func (s *Store) redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	msg := s.redact(err.Error())
+	if msg == err.Error() {
+		return err
+	}
+
+	return &redactedError{err: err, msg: msg}
+}
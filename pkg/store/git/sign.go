@@ -0,0 +1,176 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	// SigningOpenPGP signs commits with a GPG (OpenPGP) private key
+	SigningOpenPGP = "openpgp"
+
+	// SigningSSH signs commits with an SSH private key (requires git >= 2.34,
+	// and the exec driver)
+	SigningSSH = "ssh"
+)
+
+// gpgWrapper runs gpg with the signing key passphrase from the environment,
+// so it never appears in commands arguments.
+const gpgWrapper = `#!/bin/sh
+exec gpg --batch --pinentry-mode loopback --passphrase-fd 3 "$@" 3<<EOF
+$KATAFYGIO_SIGNING_PASSPHRASE
+EOF
+`
+
+// signer holds the loaded commits signing key
+type signer struct {
+	format string
+	entity *openpgp.Entity // openpgp keys, decrypted
+	keyID  string          // openpgp keys id
+	home   string          // exec driver's gpg home (keyring and wrapper)
+}
+
+// setupSigning loads and validates the SigningKey, if any: a misconfigured
+// signing must prevent the store from starting, rather than ending up with
+// unsigned commits.
+func (s *Store) setupSigning() error {
+	if s.SigningKey == "" || s.signer != nil {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(s.SigningKey)
+	if err != nil {
+		return fmt.Errorf("failed to read signing key: %v", err)
+	}
+
+	switch {
+	case bytes.Contains(data, []byte("BEGIN PGP PRIVATE KEY BLOCK")):
+		s.signer, err = s.openPGPSigner(data)
+	case bytes.Contains(data, []byte("PRIVATE KEY")):
+		s.signer, err = s.sshSigner(data)
+	default:
+		err = fmt.Errorf("%s isn't an armored GPG or an SSH private key", s.SigningKey)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrSigning, err)
+	}
+
+	return nil
+}
+
+func (s *Store) openPGPSigner(data []byte) (*signer, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil || len(entities) == 0 || entities[0].PrivateKey == nil {
+		return nil, fmt.Errorf("failed to parse GPG private key %s: %v", s.SigningKey, err)
+	}
+
+	entity := entities[0]
+	if entity.PrivateKey.Encrypted {
+		if err = entity.PrivateKey.Decrypt([]byte(s.SigningPassphrase)); err != nil {
+			return nil, fmt.Errorf("failed to decrypt GPG private key: %v", err)
+		}
+	}
+	for _, sub := range entity.Subkeys {
+		if sub.PrivateKey != nil && sub.PrivateKey.Encrypted {
+			if err = sub.PrivateKey.Decrypt([]byte(s.SigningPassphrase)); err != nil {
+				return nil, fmt.Errorf("failed to decrypt GPG private subkey: %v", err)
+			}
+		}
+	}
+
+	sig := &signer{format: SigningOpenPGP, entity: entity, keyID: entity.PrimaryKey.KeyIdString()}
+	if s.Driver != DriverExec {
+		return sig, nil
+	}
+
+	// the git command needs the key in a gpg keyring
+	sig.home, err = ioutil.TempDir("", "katafygio-gnupg-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a gpg home: %v", err)
+	}
+
+	cmd := exec.Command("gpg", "--batch", "--import", s.SigningKey) // #nosec
+	cmd.Env = append(os.Environ(), "GNUPGHOME="+sig.home)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		_ = os.RemoveAll(sig.home)
+		return nil, fmt.Errorf("failed to import GPG private key: %v: %s", err, bytes.TrimSpace(out))
+	}
+
+	err = ioutil.WriteFile(filepath.Join(sig.home, "gpg-wrapper"), []byte(gpgWrapper), 0700) // #nosec
+	if err != nil {
+		_ = os.RemoveAll(sig.home)
+		return nil, fmt.Errorf("failed to write a gpg wrapper: %v", err)
+	}
+
+	return sig, nil
+}
+
+func (s *Store) sshSigner(data []byte) (*signer, error) {
+	if s.Driver != DriverExec {
+		return nil, fmt.Errorf("SSH commits signing requires the %s git driver", DriverExec)
+	}
+
+	var err error
+	if s.SigningPassphrase == "" {
+		_, err = gossh.ParsePrivateKey(data)
+	} else {
+		_, err = gossh.ParsePrivateKeyWithPassphrase(data, []byte(s.SigningPassphrase))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load SSH private key %s: %v", s.SigningKey, err)
+	}
+
+	return &signer{format: SigningSSH}, nil
+}
+
+// cleanupSigning removes the exec driver's gpg keyring
+func (s *Store) cleanupSigning() {
+	if s.signer != nil && s.signer.home != "" {
+		_ = os.RemoveAll(s.signer.home)
+	}
+	s.signer = nil
+}
+
+// signEnv returns the environment variables configuring the git command
+// to sign commits
+func (s *Store) signEnv() []string {
+	if s.signer == nil {
+		return nil
+	}
+
+	config := [][2]string{{"gpg.format", s.signer.format}}
+	var env []string
+
+	switch s.signer.format {
+	case SigningOpenPGP:
+		config = append(config,
+			[2]string{"user.signingkey", s.signer.keyID},
+			[2]string{"gpg.program", filepath.Join(s.signer.home, "gpg-wrapper")})
+		env = append(env, "GNUPGHOME="+s.signer.home, "KATAFYGIO_SIGNING_PASSPHRASE="+s.SigningPassphrase)
+	case SigningSSH:
+		config = append(config, [2]string{"user.signingkey", s.SigningKey})
+		if s.SigningPassphrase != "" {
+			// answered by the askpass helper, on ssh-keygen's prompt
+			env = append(env, "KATAFYGIO_SIGNING_KEY="+s.SigningKey,
+				"KATAFYGIO_SIGNING_PASSPHRASE="+s.SigningPassphrase)
+		}
+	}
+
+	env = append(env, "GIT_CONFIG_COUNT="+strconv.Itoa(len(config)))
+	for i, kv := range config {
+		env = append(env,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i, kv[0]),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i, kv[1]))
+	}
+
+	return env
+}
@@ -0,0 +1,204 @@
+package git
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bpineau/katafygio/pkg/metrics"
+	"github.com/bpineau/katafygio/pkg/schedule"
+)
+
+const (
+	// SnapshotPrefix prefixes the snapshot tags names. Only those tags are
+	// subject to the retention policy.
+	SnapshotPrefix = "snapshot/"
+
+	// snapshotLayout names snapshot tags after their (UTC) schedule time,
+	// ie. "snapshot/2021-02-01T0000Z"
+	snapshotLayout = "2006-01-02T1504Z"
+)
+
+// setupSnapshots parses the SnapshotSchedule, if any
+func (s *Store) setupSnapshots() error {
+	if s.SnapshotSchedule == "" {
+		return nil
+	}
+
+	if s.SnapshotKeepHourly < 0 || s.SnapshotKeepDaily < 0 || s.SnapshotKeepMonthly < 0 {
+		return fmt.Errorf("snapshots retention counts can't be negative")
+	}
+
+	sched, err := schedule.Parse(s.SnapshotSchedule)
+	if err != nil {
+		return err
+	}
+
+	s.snapshots = sched
+	s.nextSnapshot = sched.Next(time.Now().UTC())
+	if s.nextSnapshot.IsZero() {
+		return fmt.Errorf("snapshot schedule %q never fires", s.SnapshotSchedule)
+	}
+
+	return nil
+}
+
+// snapshotDue tells if the next scheduled snapshot time passed
+func (s *Store) snapshotDue(now time.Time) bool {
+	return s.snapshots != nil && !now.Before(s.nextSnapshot)
+}
+
+// snapshot tags the repository for the due snapshot, and schedules the next one
+func (s *Store) snapshot() {
+	due := s.nextSnapshot
+	s.nextSnapshot = s.snapshots.Next(time.Now().UTC())
+
+	if err := s.Snapshot(due); err != nil {
+		s.Logger.Errorf("%v", err)
+	}
+}
+
+// Snapshot creates an annotated (and signed, when a SigningKey is set) tag
+// named after the snapshot time on the current commit, prunes the snapshots
+// exceeding the retention policy, and syncs the snapshot tags with the
+// remote repository.
+func (s *Store) Snapshot(at time.Time) error {
+	if s.DryRun {
+		return nil
+	}
+
+	at = at.UTC()
+	name := SnapshotPrefix + at.Format(snapshotLayout)
+	msg := fmt.Sprintf("Kubernetes cluster state on %s", at.Format("2006-01-02 15:04 MST"))
+
+	start := time.Now()
+	err := s.driver().tag(name, msg)
+	if err != nil {
+		metrics.GitFailures.WithLabelValues("tag").Inc()
+		return fmt.Errorf("failed to create snapshot tag %s: %w", name, err)
+	}
+	metrics.GitDuration.WithLabelValues("tag").Observe(time.Since(start).Seconds())
+
+	s.Logger.Infof("Created snapshot tag %s", name)
+
+	return s.syncSnapshots()
+}
+
+// syncSnapshots deletes expired snapshot tags, and pushes the new ones. Expired
+// tags are deleted locally only once deleted from the remote repository, so
+// failed deletions are retried with the next snapshot.
+func (s *Store) syncSnapshots() error {
+	local, remote, err := s.driver().tags(SnapshotPrefix)
+	if err != nil {
+		metrics.GitFailures.WithLabelValues("tag").Inc()
+		return fmt.Errorf("failed to list snapshot tags: %w", err)
+	}
+
+	expired := expiredSnapshots(append(local, remote...),
+		s.SnapshotKeepHourly, s.SnapshotKeepDaily, s.SnapshotKeepMonthly)
+
+	if s.URL != "" {
+		var push, remove []string
+		pushed := make(map[string]bool)
+		for _, tag := range remote {
+			pushed[tag] = true
+			if expired[tag] {
+				remove = append(remove, tag)
+			}
+		}
+		for _, tag := range local {
+			if !pushed[tag] && !expired[tag] {
+				push = append(push, tag)
+			}
+		}
+
+		if err = s.driver().pushTags(push, remove); err != nil {
+			metrics.GitFailures.WithLabelValues("push").Inc()
+			return fmt.Errorf("failed to push snapshot tags: %w", err)
+		}
+	}
+
+	var prune []string
+	for _, tag := range local {
+		if expired[tag] {
+			prune = append(prune, tag)
+		}
+	}
+
+	if err = s.driver().deleteTags(prune); err != nil {
+		metrics.GitFailures.WithLabelValues("tag").Inc()
+		return fmt.Errorf("failed to delete expired snapshot tags: %w", err)
+	}
+
+	if len(prune) > 0 {
+		s.Logger.Infof("Deleted expired snapshot tags: %s", strings.Join(prune, ", "))
+	}
+
+	return nil
+}
+
+// expiredSnapshots returns the snapshot tags exceeding the retention policy:
+// we keep the first snapshot of each of the latest hourly, daily and monthly
+// periods (ie. the cluster state on the 1st of each month). Tags whose name
+// doesn't parse as a snapshot time are kept, as are all tags when no
+// retention is set.
+func expiredSnapshots(tags []string, hourly, daily, monthly int) map[string]bool {
+	expired := make(map[string]bool)
+	if hourly == 0 && daily == 0 && monthly == 0 {
+		return expired
+	}
+
+	dates := make(map[string]time.Time)
+	var names []string
+	for _, tag := range tags {
+		if _, ok := dates[tag]; ok {
+			continue
+		}
+		t, err := time.Parse(snapshotLayout, strings.TrimPrefix(tag, SnapshotPrefix))
+		if err != nil || !strings.HasPrefix(tag, SnapshotPrefix) {
+			continue
+		}
+		dates[tag] = t
+		names = append(names, tag)
+	}
+
+	sort.Slice(names, func(i, j int) bool { return dates[names[i]].Before(dates[names[j]]) })
+
+	keep := make(map[string]bool)
+	policies := []struct {
+		count  int
+		period string
+	}{
+		{hourly, "2006-01-02T15"},
+		{daily, "2006-01-02"},
+		{monthly, "2006-01"},
+	}
+
+	for _, policy := range policies {
+		var firsts []string
+		seen := make(map[string]bool)
+		for _, name := range names {
+			period := dates[name].Format(policy.period)
+			if !seen[period] {
+				seen[period] = true
+				firsts = append(firsts, name)
+			}
+		}
+
+		if len(firsts) > policy.count {
+			firsts = firsts[len(firsts)-policy.count:]
+		}
+		for _, name := range firsts {
+			keep[name] = true
+		}
+	}
+
+	for _, name := range names {
+		if !keep[name] {
+			expired[name] = true
+		}
+	}
+
+	return expired
+}
@@ -0,0 +1,247 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	signAlgorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat = "20060102T150405Z"
+	metaChecksum  = "X-Amz-Meta-Katafygio-Crc64"
+)
+
+// client is a minimal S3 API client (path-style requests, AWS signature v4),
+// implementing just what we need to maintain a bucket's content.
+type client struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	http      *http.Client
+}
+
+type remoteObject struct {
+	Key  string `xml:"Key"`
+	ETag string `xml:"ETag"`
+}
+
+type listResult struct {
+	Contents              []remoteObject `xml:"Contents"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	NextContinuationToken string         `xml:"NextContinuationToken"`
+}
+
+type apiError struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func newClient(endpoint, bucket, region, accessKey, secretKey string, timeout time.Duration) (*client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %s: %v", endpoint, err)
+	}
+
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %s: expecting an http(s)://host[:port] url", endpoint)
+	}
+
+	return &client{
+		endpoint:  u,
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		http:      &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (c *client) list(prefix string) ([]remoteObject, error) {
+	var objects []remoteObject
+	token := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		body, _, err := c.do("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var res listResult
+		if err = xml.Unmarshal(body, &res); err != nil {
+			return nil, fmt.Errorf("failed to parse bucket listing: %v", err)
+		}
+
+		objects = append(objects, res.Contents...)
+
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+func (c *client) get(key string) ([]byte, error) {
+	body, _, err := c.do("GET", key, nil, nil, nil)
+	return body, err
+}
+
+func (c *client) put(key string, data []byte, checksum uint64) error {
+	headers := map[string]string{
+		metaChecksum:   fmt.Sprintf("%d", checksum),
+		"Content-Type": "application/yaml",
+	}
+	if strings.HasSuffix(key, ".json") {
+		headers["Content-Type"] = "application/json"
+	}
+	_, _, err := c.do("PUT", key, nil, headers, data)
+	return err
+}
+
+func (c *client) delete(key string) error {
+	_, _, err := c.do("DELETE", key, nil, nil, nil)
+	return err
+}
+
+func (c *client) do(method, key string, query url.Values, headers map[string]string, payload []byte) ([]byte, http.Header, error) {
+	u := *c.endpoint
+	u.Path = "/" + c.bucket
+	u.RawPath = "/" + uriEncode(c.bucket, false)
+	if key != "" {
+		u.Path += "/" + key
+		u.RawPath += "/" + uriEncode(key, false)
+	}
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(payload))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	c.sign(req, payload, time.Now().UTC())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("s3 %s %s failed: %v", method, key, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("s3 %s %s failed: %v", method, key, err)
+	}
+
+	if resp.StatusCode/100 != 2 {
+		var apierr apiError
+		_ = xml.Unmarshal(body, &apierr)
+		return nil, nil, fmt.Errorf("s3 %s %s failed with code %d: %s %s",
+			method, key, resp.StatusCode, apierr.Code, apierr.Message)
+	}
+
+	return body, resp.Header, nil
+}
+
+// sign adds an AWS signature version 4 to the request
+func (c *client) sign(req *http.Request, payload []byte, now time.Time) {
+	payloadHash := sha256.Sum256(payload)
+	amzDate := now.Format(amzDateFormat)
+	day := now.Format("20060102")
+
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	var names []string
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := signAlgorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), day)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		signAlgorithm, c.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func canonicalQuery(query url.Values) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var params []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+// uriEncode escapes a string the way AWS signature v4 expects it
+func uriEncode(s string, encodeSlash bool) string {
+	var buf strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			buf.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			buf.WriteByte(b)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
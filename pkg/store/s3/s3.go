@@ -0,0 +1,352 @@
+// Package s3 keeps an S3 compatible bucket in sync with a local directory.
+// Changed files are uploaded (possibly creating new objects versions, when
+// the bucket is versioned), and files removed from the local directory are
+// deleted from the bucket (leaving a tombstone, on versioned buckets).
+//
+// The files to sync are those the recorder notifies (through Send) as written
+// or removed, and unchanged files are detected with the recorder's checksums,
+// so they aren't uploaded again; at startup, the bucket content is fetched into
+// the local directory (files missing locally), like a git clone would.
+package s3
+
+import (
+	"crypto/md5" // #nosec (used by S3 for ETags, not for security)
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/bpineau/katafygio/pkg/event"
+	"github.com/bpineau/katafygio/pkg/recorder"
+)
+
+var (
+	// CheckInterval defines the interval between local directory checks
+	CheckInterval = 10 * time.Second
+
+	// DefaultRegion is used when no region is provided
+	DefaultRegion = "us-east-1"
+)
+
+var appFs = afero.NewOsFs()
+
+type logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Store will maintain a bucket content in sync with dumped kube objects
+type Store struct {
+	Logger    logger
+	LocalDir  string
+	Endpoint  string
+	Bucket    string
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Timeout   time.Duration
+	DryRun    bool
+
+	client  *client
+	lock    sync.Mutex // protect remote, pending and pushing
+	remote  map[string]uint64
+	pending map[string]bool // keys to upload (true) or delete (false)
+	pushing map[string]bool // keys being uploaded or deleted
+	stopch  chan struct{}
+	donech  chan struct{}
+}
+
+// New instantiate a new s3 Store. prefix is optional.
+func New(log logger, dryRun bool, dir, endpoint, bucket, prefix, region, accessKey, secretKey string,
+	timeout time.Duration) *Store {
+	if region == "" {
+		region = DefaultRegion
+	}
+
+	return &Store{
+		Logger:    log,
+		LocalDir:  dir,
+		Endpoint:  endpoint,
+		Bucket:    bucket,
+		Prefix:    strings.Trim(prefix, "/"),
+		Region:    region,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Timeout:   timeout,
+		DryRun:    dryRun,
+		remote:    make(map[string]uint64),
+		pending:   make(map[string]bool),
+	}
+}
+
+// Start fetches the bucket content, then keeps it in sync with the directory
+func (s *Store) Start() (*Store, error) {
+	s.Logger.Infof("Starting s3 bucket synchronizer")
+	s.stopch = make(chan struct{})
+	s.donech = make(chan struct{})
+
+	err := s.Fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		checkTick := time.NewTicker(CheckInterval)
+		defer checkTick.Stop()
+		defer close(s.donech)
+
+		for {
+			select {
+			case <-checkTick.C:
+				s.commitAndPush()
+			case <-s.stopch:
+				return
+			}
+		}
+	}()
+
+	return s, nil
+}
+
+// Stop stops the s3 goroutine, if started
+func (s *Store) Stop() {
+	s.Logger.Infof("Stopping s3 bucket synchronizer")
+	if s.stopch != nil {
+		close(s.stopch)
+		<-s.donech
+	}
+}
+
+// Fetch lists the bucket objects, and downloads those missing from the local directory
+func (s *Store) Fetch() (err error) {
+	if s.Bucket == "" {
+		return fmt.Errorf("a bucket name is required")
+	}
+
+	s.LocalDir, err = filepath.Abs(s.LocalDir)
+	if err != nil {
+		return fmt.Errorf("can't find local dir absolute path (broken cwd?): %v", err)
+	}
+
+	s.client, err = newClient(s.Endpoint, s.Bucket, s.Region, s.AccessKey, s.SecretKey, s.Timeout)
+	if err != nil {
+		return err
+	}
+
+	if s.DryRun {
+		return nil
+	}
+
+	objects, err := s.client.list(s.keyPrefix())
+	if err != nil {
+		return fmt.Errorf("failed to list bucket %s: %v", s.Bucket, err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, obj := range objects {
+		path := s.localPath(obj.Key)
+
+		data, err := afero.ReadFile(appFs, path)
+		if err == nil {
+			// remote content will be overwritten, unless it's identical
+			s.remote[obj.Key] = 0
+			if strings.Trim(obj.ETag, `"`) == md5sum(data) {
+				s.remote[obj.Key] = recorder.Checksum(data)
+			}
+			continue
+		}
+
+		data, err = s.client.get(obj.Key)
+		if err != nil {
+			return fmt.Errorf("failed to fetch %s: %v", obj.Key, err)
+		}
+
+		if err = appFs.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return fmt.Errorf("failed to create %s: %v", filepath.Dir(path), err)
+		}
+
+		if err = afero.WriteFile(appFs, path, data, 0600); err != nil {
+			return fmt.Errorf("failed to write %s: %v", path, err)
+		}
+
+		s.remote[obj.Key] = recorder.Checksum(data)
+	}
+
+	return nil
+}
+
+// Send records the files the recorder wrote or removed, to be uploaded or
+// deleted on next Push. Files whose checksum matches the bucket's content
+// aren't uploaded again.
+func (s *Store) Send(notif *event.Notification) {
+	if s.DryRun || notif.Path == "" {
+		return
+	}
+
+	rel, err := filepath.Rel(s.LocalDir, notif.Path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return
+	}
+	key := s.keyPrefix() + filepath.ToSlash(rel)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// the bucket content is unknown while the key is being pushed
+	prev, exists := s.remote[key]
+	settled := !s.pushing[key]
+	switch {
+	case notif.Action == event.Delete && (exists || !settled):
+		s.pending[key] = false
+	case notif.Action == event.Delete:
+		delete(s.pending, key)
+	case notif.Checksum != 0 && exists && settled && prev == notif.Checksum:
+		delete(s.pending, key)
+	default:
+		s.pending[key] = true
+	}
+}
+
+// Commit tells if files changed since the last upload, as notified by the recorder
+func (s *Store) Commit() (changed bool, err error) {
+	if s.DryRun {
+		return false, nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.pending) > 0, nil
+}
+
+// Push uploads or deletes the changed files. The lock isn't held during the
+// transfers, so a slow endpoint doesn't delay the recorder's notifications.
+func (s *Store) Push() error {
+	s.lock.Lock()
+	pending := s.pending
+	s.pending = make(map[string]bool)
+	s.pushing = pending
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		s.pushing = nil
+		s.lock.Unlock()
+	}()
+
+	failures := 0
+	for key, upload := range pending {
+		var err error
+		if upload {
+			err = s.upload(key)
+		} else {
+			err = s.remove(key)
+		}
+
+		if err != nil {
+			s.Logger.Errorf("%v", err)
+			s.requeue(key, upload)
+			failures++
+		}
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("failed to sync %d objects to bucket %s", failures, s.Bucket)
+	}
+
+	return nil
+}
+
+// requeue retries a failed transfer on next Push, unless the key was notified
+// again meanwhile
+func (s *Store) requeue(key string, upload bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, ok := s.pending[key]; !ok {
+		s.pending[key] = upload
+	}
+}
+
+func (s *Store) upload(key string) error {
+	path := s.localPath(key)
+
+	data, err := afero.ReadFile(appFs, path)
+	if os.IsNotExist(err) {
+		// removed since notified
+		s.lock.Lock()
+		_, exists := s.remote[key]
+		s.lock.Unlock()
+		if !exists {
+			return nil
+		}
+		return s.remove(key)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	sum := recorder.Checksum(data)
+	if err = s.client.put(key, data, sum); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	s.remote[key] = sum
+	s.lock.Unlock()
+
+	return nil
+}
+
+func (s *Store) remove(key string) error {
+	if err := s.client.delete(key); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	delete(s.remote, key)
+	s.lock.Unlock()
+
+	return nil
+}
+
+func (s *Store) keyPrefix() string {
+	if s.Prefix == "" {
+		return ""
+	}
+	return s.Prefix + "/"
+}
+
+func (s *Store) localPath(key string) string {
+	rel := filepath.FromSlash(strings.TrimPrefix(key, s.keyPrefix()))
+	return filepath.Join(s.LocalDir, filepath.Clean("/"+rel))
+}
+
+func (s *Store) commitAndPush() {
+	changed, err := s.Commit()
+	if err != nil {
+		s.Logger.Errorf("%v", err)
+	}
+
+	if !changed {
+		return
+	}
+
+	err = s.Push()
+	if err != nil {
+		s.Logger.Errorf("%v", err)
+	}
+}
+
+func md5sum(data []byte) string {
+	sum := md5.Sum(data) // #nosec
+	return hex.EncodeToString(sum[:])
+}
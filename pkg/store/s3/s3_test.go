@@ -0,0 +1,302 @@
+package s3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+
+	"github.com/bpineau/katafygio/pkg/event"
+	"github.com/bpineau/katafygio/pkg/recorder"
+)
+
+type mockLog struct{}
+
+func (m *mockLog) Infof(format string, args ...interface{})  {}
+func (m *mockLog) Errorf(format string, args ...interface{}) {}
+
+// fakeS3 is a minimal, in memory, S3 compatible server
+type fakeS3 struct {
+	sync.Mutex
+	objects    map[string][]byte
+	puts       int
+	tombstones int
+	fail       bool
+	stalled    chan struct{} // when set, uploads wait for stall to be closed
+	stall      chan struct{}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.stall != nil && r.Method == "PUT" {
+		f.stalled <- struct{}{}
+		<-f.stall
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	sum := sha256.Sum256(body)
+	auth := r.Header.Get("Authorization")
+	if f.fail || !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=ak/") ||
+		r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "<Error><Code>AccessDenied</Code><Message>Access Denied</Message></Error>")
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case r.Method == "GET" && path == "bucket":
+		f.list(w, r)
+	case r.Method == "GET":
+		data, ok := f.objects[path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(data)
+	case r.Method == "PUT":
+		f.objects[path] = body
+		f.puts++
+	case r.Method == "DELETE":
+		delete(f.objects, path)
+		f.tombstones++
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// list returns objects by pages of 2, to exercise continuation
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	for k := range f.objects {
+		key := strings.TrimPrefix(k, "bucket/")
+		if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+	end := start + 2
+	truncated := end < len(keys)
+	if !truncated {
+		end = len(keys)
+	}
+
+	fmt.Fprint(w, "<ListBucketResult>")
+	for _, key := range keys[start:end] {
+		fmt.Fprintf(w, `<Contents><Key>%s</Key><ETag>"%s"</ETag></Contents>`, key, md5sum(f.objects["bucket/"+key]))
+	}
+	fmt.Fprintf(w, "<IsTruncated>%v</IsTruncated><NextContinuationToken>%d</NextContinuationToken>", truncated, end)
+	fmt.Fprint(w, "</ListBucketResult>")
+}
+
+// record mimics the recorder: writes (or removes, when data is nil) a file,
+// and notifies the store
+func record(repo *Store, path string, data []byte) {
+	if data == nil {
+		_ = appFs.Remove(path)
+		repo.Send(&event.Notification{Action: event.Delete, Path: path})
+		return
+	}
+
+	_ = afero.WriteFile(appFs, path, data, 0600)
+	repo.Send(&event.Notification{Action: event.Upsert, Path: path, Checksum: recorder.Checksum(data)})
+}
+
+func TestS3(t *testing.T) {
+	appFs = afero.NewMemMapFs()
+	fake := &fakeS3{objects: map[string][]byte{
+		"bucket/backups/remote1.yaml":     []byte("remote1"),
+		"bucket/backups/ns/remote2.yaml":  []byte("remote2"),
+		"bucket/backups/unchanged.yaml":   []byte("same"),
+		"bucket/backups/overwritten.yaml": []byte("old"),
+		"bucket/other/foo.yaml":           []byte("not ours"),
+	}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	_ = afero.WriteFile(appFs, "/tmp/ktest/unchanged.yaml", []byte("same"), 0600)
+	_ = afero.WriteFile(appFs, "/tmp/ktest/overwritten.yaml", []byte("new"), 0600)
+
+	repo, err := New(new(mockLog), false, "/tmp/ktest", srv.URL, "bucket", "/backups/", "",
+		"ak", "sk", time.Second).Start()
+	if err != nil {
+		t.Fatalf("failed to start s3 store: %v", err)
+	}
+
+	data, _ := afero.ReadFile(appFs, "/tmp/ktest/ns/remote2.yaml")
+	if string(data) != "remote2" {
+		t.Error("remote objects should be fetched at startup")
+	}
+
+	data, _ = afero.ReadFile(appFs, "/tmp/ktest/overwritten.yaml")
+	if string(data) != "new" {
+		t.Error("fetching remote objects shouldn't overwrite local files")
+	}
+
+	changed, err := repo.Commit()
+	if changed || err != nil {
+		t.Errorf("Commit shouldn't notify changes before the recorder did (%v)", err)
+	}
+
+	// the recorder rewrites the files at startup
+	record(repo, "/tmp/ktest/unchanged.yaml", []byte("same"))
+	record(repo, "/tmp/ktest/overwritten.yaml", []byte("new"))
+	record(repo, "/tmp/ktest/ns/new.yaml", []byte("new"))
+	record(repo, "/tmp/ktest/remote1.yaml", nil)
+	record(repo, "/tmp/ktest/never-uploaded.yaml", []byte("gone"))
+	record(repo, "/tmp/ktest/never-uploaded.yaml", nil)
+	record(repo, "/elsewhere/foo.yaml", []byte("foo"))
+	_ = afero.WriteFile(appFs, "/tmp/ktest/ns/.temp-katafygio-42", []byte("tmp"), 0600)
+
+	changed, err = repo.Commit()
+	if !changed || err != nil {
+		t.Errorf("Commit should notify changes and not fail (%v)", err)
+	}
+
+	if err = repo.Push(); err != nil {
+		t.Errorf("Push shouldn't fail (%v)", err)
+	}
+
+	if string(fake.objects["bucket/backups/ns/new.yaml"]) != "new" {
+		t.Error("new files should be uploaded")
+	}
+
+	if string(fake.objects["bucket/backups/overwritten.yaml"]) != "new" {
+		t.Error("changed files should be uploaded")
+	}
+
+	if _, ok := fake.objects["bucket/backups/remote1.yaml"]; ok || fake.tombstones != 1 {
+		t.Error("removed files should be deleted from the bucket")
+	}
+
+	if _, ok := fake.objects["bucket/backups/ns/.temp-katafygio-42"]; ok {
+		t.Error("temporary files shouldn't be uploaded")
+	}
+
+	if _, ok := fake.objects["bucket/other/foo.yaml"]; !ok {
+		t.Error("objects outside of the prefix shouldn't be touched")
+	}
+
+	if fake.puts != 2 {
+		t.Errorf("only changed files should be uploaded (got %d uploads)", fake.puts)
+	}
+
+	changed, err = repo.Commit()
+	if changed || err != nil {
+		t.Errorf("Commit shouldn't notify changes on unchanged directory (%v)", err)
+	}
+
+	// failures are retried on next push
+	record(repo, "/tmp/ktest/ns/new.yaml", []byte("newer"))
+	fake.fail = true
+	repo.commitAndPush()
+	if string(fake.objects["bucket/backups/ns/new.yaml"]) != "new" {
+		t.Error("uploads should fail with a failing server")
+	}
+
+	fake.fail = false
+	if err = repo.Push(); err != nil {
+		t.Errorf("Push should recover from failures (%v)", err)
+	}
+
+	if string(fake.objects["bucket/backups/ns/new.yaml"]) != "newer" {
+		t.Error("failed uploads should be retried")
+	}
+
+	// files removed after being notified as written are deleted
+	record(repo, "/tmp/ktest/unchanged.yaml", []byte("changed"))
+	_ = appFs.Remove("/tmp/ktest/unchanged.yaml")
+	repo.commitAndPush()
+	if _, ok := fake.objects["bucket/backups/unchanged.yaml"]; ok {
+		t.Error("files removed since notified should be deleted from the bucket")
+	}
+
+	// a slow endpoint doesn't block the recorder's notifications
+	fake.stalled, fake.stall = make(chan struct{}, 1), make(chan struct{})
+	record(repo, "/tmp/ktest/slow.yaml", []byte("slow"))
+	pushed := make(chan error)
+	go func() { pushed <- repo.Push() }()
+	<-fake.stalled
+
+	notified := make(chan struct{})
+	go func() {
+		record(repo, "/tmp/ktest/slow.yaml", nil)
+		close(notified)
+	}()
+	select {
+	case <-notified:
+	case <-time.After(time.Second):
+		t.Error("notifications shouldn't wait for the uploads in progress")
+	}
+
+	close(fake.stall)
+	if err = <-pushed; err != nil {
+		t.Errorf("Push shouldn't fail (%v)", err)
+	}
+	fake.stall = nil
+
+	// removed while being uploaded: deleted on next push
+	if err = repo.Push(); err != nil {
+		t.Errorf("Push shouldn't fail (%v)", err)
+	}
+	if _, ok := fake.objects["bucket/backups/slow.yaml"]; ok {
+		t.Error("files removed while being uploaded should be deleted from the bucket")
+	}
+
+	repo.Stop()
+
+	fake.fail = true
+	if _, err = New(new(mockLog), false, "/tmp/ktest", srv.URL, "bucket", "", "", "ak", "sk",
+		time.Second).Start(); err == nil {
+		t.Error("Start should fail when the bucket can't be listed")
+	}
+
+	if _, err = New(new(mockLog), false, "/tmp/ktest", "not an url", "bucket", "", "", "ak", "sk",
+		time.Second).Start(); err == nil {
+		t.Error("Start should fail with an invalid endpoint")
+	}
+}
+
+func TestS3DryRun(t *testing.T) {
+	appFs = afero.NewMemMapFs()
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	repo, err := New(new(mockLog), true, "/tmp/ktest", srv.URL, "bucket", "", "", "ak", "sk",
+		time.Second).Start()
+	if err != nil {
+		t.Fatalf("failed to start s3 store: %v", err)
+	}
+
+	record(repo, "/tmp/ktest/foo.yaml", []byte("foo"))
+	repo.commitAndPush()
+	repo.Stop()
+
+	if len(fake.objects) != 0 {
+		t.Error("nothing should be uploaded in dry-run mode")
+	}
+}
+
+func TestURIEncode(t *testing.T) {
+	if got := uriEncode("ns/foo bar:baz~.yaml", false); got != "ns/foo%20bar%3Abaz~.yaml" {
+		t.Errorf("unexpected path encoding: %s", got)
+	}
+
+	if got := uriEncode("ns/foo", true); got != "ns%2Ffoo" {
+		t.Errorf("unexpected query encoding: %s", got)
+	}
+}
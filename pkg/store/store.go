@@ -0,0 +1,50 @@
+// Package store defines the interface storage backends implement. A backend
+// persists the content of the local dump directory (where the recorder saves
+// the objects), ie. by versioning it in a git repository.
+//
+// Backends are started by their own constructor's Start() method, and keep
+// synchronizing the local directory in the background until stopped.
+package store
+
+import "github.com/bpineau/katafygio/pkg/event"
+
+// Backend persists the local dump directory
+type Backend interface {
+	// Commit persists the local directory changes, if any
+	Commit() (changed bool, err error)
+
+	// Push propagates the committed changes to a remote storage, if any
+	Push() error
+
+	// Stop halts the background synchronization
+	Stop()
+}
+
+// Health is implemented by backends reporting their health
+type Health interface {
+	// Alive fails when the backend is stuck, and the process should be restarted
+	Alive() error
+
+	// Ready fails when the backend doesn't persist the changes
+	Ready() error
+}
+
+// Changelog is implemented by backends making use of the individual changes
+// the recorder applied to the local directory (ie. to describe them in commit
+// messages).
+type Changelog interface {
+	Send(notif *event.Notification)
+}
+
+// Reconciler is implemented by backends whose remote may move independently
+// (ie. a shared git branch), and which must integrate the remote changes
+// before pushing.
+type Reconciler interface {
+	Reconcile() error
+}
+
+// Mover is implemented by backends tracking files moves (ie. with "git mv",
+// to preserve files history). Paths are absolute.
+type Mover interface {
+	Move(from, to string) error
+}